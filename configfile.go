@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+/*
+Set the flags from a JSON config file, a single object keyed by flag name with the value the flag would get on the
+command line, e.g. {"workers": 100, "timeout": "45s", "no-builtin-stopwords": true}. A duration can also be a bare
+number of seconds, e.g. {"timeout": 45}. A repeatable flag takes an array of values, e.g. {"wordbank": ["./words.txt",
+"./tech-words.txt"]}. Flags that were given on the command line are left alone so they override the file. Keys that
+aren't a flag are an error, so a typo isn't silently ignored
+*/
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// numbers are kept as written so large integers don't go through a float
+	var config map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&config); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for name, value := range config {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown key %q", name)
+		}
+		if explicit[name] {
+			continue
+		}
+		isDuration := false
+		if getter, ok := fs.Lookup(name).Value.(flag.Getter); ok {
+			_, isDuration = getter.Get().(time.Duration)
+		}
+
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		for _, v := range values {
+			var s string
+			switch v := v.(type) {
+			case string:
+				s = v
+			case json.Number:
+				s = v.String()
+				// a bare number is seconds, time.ParseDuration wants a unit
+				if isDuration {
+					s += "s"
+				}
+			case bool:
+				s = fmt.Sprint(v)
+			default:
+				return fmt.Errorf("%q must be a string, number, boolean or an array of them", name)
+			}
+			if err := fs.Set(name, s); err != nil {
+				return fmt.Errorf("%q: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestApplyConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"workers": 100, "timeout": 45, "min-delay": "250ms", "max-delay": 1.5, "wordbank": ["a.txt", "b.txt"]}`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	workers := fs.Int("workers", 50, "")
+	timeout := fs.Duration("timeout", 30*time.Second, "")
+	minDelay := fs.Duration("min-delay", 0, "")
+	maxDelay := fs.Duration("max-delay", 0, "")
+	wordBanks := stringsFlag{}
+	fs.Var(&wordBanks, "wordbank", "")
+	// given on the command line, so the file doesn't override it
+	if err := fs.Parse([]string{"-workers", "10"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := applyConfigFile(fs, path); err != nil {
+		t.Fatalf("applyConfigFile() error = %v", err)
+	}
+	if *workers != 10 {
+		t.Errorf("workers = %d, want the command line's 10", *workers)
+	}
+	// bare numbers are seconds for durations
+	if *timeout != 45*time.Second {
+		t.Errorf("timeout = %v, want 45s", *timeout)
+	}
+	if *maxDelay != 1500*time.Millisecond {
+		t.Errorf("max-delay = %v, want 1.5s", *maxDelay)
+	}
+	if *minDelay != 250*time.Millisecond {
+		t.Errorf("min-delay = %v, want 250ms", *minDelay)
+	}
+	if len(wordBanks) != 2 {
+		t.Errorf("wordbank = %v, want both files", wordBanks)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"top-10-essay-word-counter/wordcounter"
+)
+
+/*
+Answer queries about the counted words read line by line from in until quit or the end of the input, after a run
+with -interactive. A word prints its count and rank, "top N" prints the N most common words (10 by default). Ranks
+are by count with ties broken alphabetically like the output, whatever -rank or -sort the output used
+*/
+func runInteractive(in io.Reader, out io.Writer, prompt io.Writer, wordMap map[string]int) error {
+	// every word is ranked once up front so each query is just a lookup
+	ranked := wordcounter.TopWords(wordMap, len(wordMap))
+	ranks := make(map[string]int, len(ranked))
+	for i, wordCount := range ranked {
+		ranks[wordCount.Word] = i + 1
+	}
+
+	fmt.Fprintf(out, "%d distinct words counted, enter a word, top N or quit\n", len(ranked))
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(prompt, "> ")
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+
+		fields := strings.Fields(strings.ToLower(scanner.Text()))
+		switch {
+		case len(fields) == 0:
+			continue
+		case fields[0] == "quit" || fields[0] == "exit":
+			return nil
+		case fields[0] == "help":
+			fmt.Fprintln(out, "WORD    count and rank of the word")
+			fmt.Fprintln(out, "top N   the N most common words, 10 if N is left out")
+			fmt.Fprintln(out, "quit    leave")
+		case fields[0] == "top":
+			n := 10
+			if len(fields) > 1 {
+				var err error
+				if n, err = strconv.Atoi(fields[1]); err != nil || n <= 0 {
+					fmt.Fprintf(out, "top needs a positive number, got %q\n", fields[1])
+					continue
+				}
+			}
+			for i, wordCount := range ranked[:min(n, len(ranked))] {
+				fmt.Fprintf(out, "%d. %s %d\n", i+1, wordCount.Word, wordCount.Count)
+			}
+		default:
+			// phrases from -ngram are looked up with their words joined by a space, like they are counted
+			word := strings.Join(fields, " ")
+			rank, ok := ranks[word]
+			if !ok {
+				fmt.Fprintf(out, "%s was not counted\n", word)
+				continue
+			}
+			fmt.Fprintf(out, "%s: count %d, rank %d of %d\n", word, wordMap[word], rank, len(ranked))
+		}
+	}
+}
@@ -1,27 +1,107 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
-	"log"
-	"math/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
-	"sort"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
-	"golang.org/x/net/html"
+	"top-10-essay-word-counter/wordcounter"
 )
 
-const WordBankUrl = "https://raw.githubusercontent.com/dwyl/english-words/master/words.txt"
-const MaxGoRoutines = 1000
+// Exit code when more essays than -rate-limit-threshold were rate limited, other failures exit with 1
+const ExitRateLimited = 3
 
-type WordCount struct {
-	Word  string `json:"word"`
-	Count int    `json:"count"`
+// Exit code when fewer valid words than -min-total-words were counted across all essays, e.g. every essay failed
+const ExitNoWords = 4
+
+// Exit code when the run was interrupted (Ctrl-C or SIGTERM) and only the partial result was written
+const ExitInterrupted = 5
+
+// Log a setup failure and exit, slog has no Fatal like log does
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Repeatable string flag, each use adds a value
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// Repeatable -header flag, each value is a "Key: Value" header added to every essay request
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	var headers []string
+	for key, values := range h {
+		for _, value := range values {
+			headers = append(headers, key+": "+value)
+		}
+	}
+	return strings.Join(headers, ", ")
+}
+
+func (h headerFlags) Set(value string) error {
+	key, val, ok := strings.Cut(value, ":")
+	if !ok || strings.TrimSpace(key) == "" {
+		return fmt.Errorf("header must be in the form \"Key: Value\", got %q", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(key), strings.TrimSpace(val))
+	return nil
+}
+
+// Version of the JSON output, bumped whenever a field is renamed, removed or changes meaning. New fields can be added
+// without a bump so consumers should ignore fields they don't know
+const OutputVersion = 1
+
+/*
+JSON output of a run:
+
+	version         OutputVersion, the shape of the rest of the output
+	words           the top words, each with its count, doc_freq, percent and (with -rank tfidf, -normalize or -recency-weight) score
+	frequent_words  every word making up at least -min-freq-percent of all valid words, only set with -min-freq-percent
+	summary         word totals, essays processed and failed, the response status codes, the timings of each phase and (with -stats) peak runtime and word length stats
+	categories      each category of the essay manifest mapped to its top words, only set with -by-category
+	groups          each group of words (a first letter or a length) mapped to its top words, only set with -group-by
+	essays          each essay URL mapped to its own top words, only set with -per-essay
+	histogram       how many distinct words have a count in each bucket (1, 2-4, 5-9...), only set with -histogram
+*/
+type Output struct {
+	Version int                     `json:"version"`
+	Words   []wordcounter.WordCount `json:"words"`
+	// every word making up at least -min-freq-percent of all valid words, only set with -min-freq-percent
+	FrequentWords []wordcounter.WordCount            `json:"frequent_words,omitempty"`
+	Summary       wordcounter.Summary                `json:"summary"`
+	Categories    map[string][]wordcounter.WordCount `json:"categories,omitempty"`
+	Groups        map[string][]wordcounter.WordCount `json:"groups,omitempty"`
+	Essays        map[string][]wordcounter.WordCount `json:"essays,omitempty"`
+	// number of distinct words in each count bucket, only set with -histogram
+	Histogram []wordcounter.HistogramBucket `json:"histogram,omitempty"`
 }
 
 /*
@@ -51,206 +131,784 @@ There are some considerations to be made:
 2. Cannot make too many requests at once as well, as again this could cause rate limiting
 
 Solutions for the above are:
-1. Spin up max 1000 goroutines
-2. Add a random sleep between 200-100msec before initiating a request so that not all requests are made at once
+1. Use a bounded pool of worker goroutines (50 by default) that read essay URLs off a channel
+2. Add a random sleep between 200-1000msec (configurable with -min-delay and -max-delay) before initiating a request so that not all requests are made at once
 
-However due to engadgets policies you may still be rate limited if you run the script too often at once, in that case a log is placed
+However due to engadgets policies you may still be rate limited if you run the script too often at once, in that case a log is placed,
+rate limited requests (429/503) are retried with exponential backoff before the essay is skipped
 */
 func main() {
-	// Get word bank from URL given in assignment
-	wordBank := getWordBank(WordBankUrl)
-	log.Println("Number of words in word bank: ", len(*wordBank))
-
-	// Get list of essay URLs
-	essays := getEssays("./endg-urls.txt")
-	log.Println("Number of essays: ", len(*essays))
-
-	// Compile regex for valid words so that it can be used later
-	regExpression := regexp.MustCompile(`\b[a-z]{3,}\b`)
-
-	// word map to store the count of each word, made global so all goroutines can read/write concurrently
-	wordMap := make(map[string]int, 0)
-
-	// Concurrently process 1000 essays at a time to avoid too many goroutines and rate limit issues with engagdet
-	essayBatch := make([][]string, 0)
-	for i := 0; i < len(*essays); i += MaxGoRoutines {
-		endBatch := i + MaxGoRoutines
-		if endBatch > len(*essays) {
-			endBatch = len(*essays)
+	// Number of top words to output, defaults to 10 as per the assignment
+	top := flag.Int("top", 10, "number of top words to output")
+	// Number of worker goroutines fetching essays concurrently, or auto to adapt it to how much the site rate limits
+	workersFlag := flag.String("workers", strconv.Itoa(wordcounter.DefaultWorkers), "number of concurrent workers fetching essays, or auto to adapt it to rate limiting")
+	maxWorkers := flag.Int("max-workers", 200, "most concurrent workers with -workers auto")
+	// Timeout for each HTTP request so a stalled server can't hang a worker forever
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout for each HTTP request")
+	// Number of times a rate limited (429/503) essay request is retried with exponential backoff
+	maxRetries := flag.Int("max-retries", 3, "max retries for rate limited essay requests")
+	// Number of times an essay request that hit a connection reset or DNS hiccup is retried right away
+	networkRetries := flag.Int("network-retries", 1, "immediate retries for essay requests that fail with a transient network error")
+	// Cap on the size of an essay body so a huge or broken page can't use up the memory
+	maxBodySize := flag.Int64("max-body-size", wordcounter.DefaultMaxBodySize, "skip essays with a body larger than this many bytes, 0 for no limit")
+	// Connection reuse, every essay is on the same host so idle connections are kept for each worker by default
+	maxIdleConnsPerHost := flag.Int("max-idle-conns-per-host", 0, "idle connections kept open per host for reuse (default the number of workers)")
+	maxConnsPerHost := flag.Int("max-conns-per-host", 0, "max connections per host, including ones in use (0 for no limit)")
+	idleConnTimeout := flag.Duration("idle-conn-timeout", 90*time.Second, "how long an idle connection is kept open for reuse")
+	// Random delay before every essay request to avoid being rate limited, both zero disables it
+	minDelay := flag.Duration("min-delay", 200*time.Millisecond, "minimum random delay before each essay request")
+	maxDelay := flag.Duration("max-delay", time.Second, "maximum random delay before each essay request")
+	// Global cap on essay requests per second shared by all workers, 0 means no limit
+	rps := flag.Float64("rps", 0, "max essay requests per second across all workers (0 for no limit)")
+	// File to write the JSON result to, if empty the result is written to stdout
+	out := flag.String("out", "", "file to write the result to (default stdout)")
+	// Output format of the result, json, csv or table
+	format := flag.String("format", "json", "output format: json, csv or table")
+	// Address to serve the word counter on over HTTP instead of doing a one-shot run, e.g. :8080
+	serve := flag.String("serve", "", "serve the word counter over HTTP on this address instead of a one-shot run")
+	// Limits on each POST /count request of -serve, so one request can't make the service read or fetch without bound
+	serveMaxBody := flag.Int64("serve-max-body", 1<<20, "largest POST /count request body in bytes with -serve, 0 for no limit")
+	serveMaxUrls := flag.Int("serve-max-urls", 1000, "most essay URLs a POST /count request can ask for with -serve, 0 for no limit")
+	// Only load and validate the word bank and essay list, without fetching any essays
+	dryRun := flag.Bool("dry-run", false, "load the word bank and essay list and validate the URLs without fetching essays")
+	// User-Agent and extra headers sent with every essay request, e.g. to look like a normal browser or pass cookies
+	userAgent := flag.String("user-agent", "", "User-Agent header to send with essay requests")
+	headers := headerFlags{}
+	flag.Var(headers, "header", "extra \"Key: Value\" header to send with essay requests, can be repeated")
+	// Word bank sources, each either an http(s) URL or a path to a local file with one word per line, merged together
+	wordBankSources := stringsFlag{}
+	flag.Var(&wordBankSources, "wordbank", "word bank URL or local file path, can be repeated to merge word banks (default "+wordcounter.WordBankUrl+")")
+	// File with one essay URL per line, "-" reads the list from stdin
+	essaysPath := flag.String("essays", "./endg-urls.txt", "file with essay URLs, one per line (\"-\" for stdin)")
+	// Only process the first N essays, for quick test runs
+	limitEssays := flag.Int("limit-essays", 0, "only process the first N essays, 0 means no limit")
+	// Process a random sample of N essays, seeded so the same sample can be taken again
+	sample := flag.Int("sample", 0, "process a random sample of N essays instead of all of them, takes precedence over -limit-essays")
+	sampleSeed := flag.Int64("seed", 0, "seed for -sample, 0 picks a random seed which is logged")
+	// Same result on every run over the same essays, for golden-file tests rather than throughput
+	deterministic := flag.Bool("deterministic", false, "fetch essays one at a time in file order without random delays and with a fixed -seed, slow, for tests")
+	// Directory of saved essay HTML files to count instead of fetching the essays, for offline and reproducible runs
+	essayDir := flag.String("essay-dir", "", "directory of saved .html essays to read instead of -essays")
+	// Also output how many distinct words fall in each count bucket, to see the long tail beyond the top words
+	histogram := flag.Bool("histogram", false, "also output how many distinct words have a count in each bucket (1, 2-4, 5-9...)")
+	// Also output each essay's own top words, useful to find which essays dominate the global top words
+	perEssay := flag.Bool("per-essay", false, "also output the top words of each essay")
+	// Also output the top words of each category of a manifest, to compare the vocabulary of sections
+	byCategory := flag.Bool("by-category", false, "also output the top words of each category of the essays in a -essays manifest")
+	// Minimum number of characters for a word to be valid, defaults to 3 as per the assignment
+	minLength := flag.Int("min-length", 3, "minimum number of characters in a valid word")
+	// Match words with any unicode letters (café, naïve) instead of only a-z, only useful if the word bank has those forms
+	unicodeWords := flag.Bool("unicode", false, "match words with unicode letters, not just a-z (word bank must contain them)")
+	// Pattern of a word instead of the a-z (or -unicode) letters, e.g. to count a German corpus with umlauts
+	tokenRegex := flag.String("token-regex", "", "regex a word has to match, overrides -min-length and -unicode, e.g. [a-zäöüß]{3,}")
+	// File with extra words to exclude from the count, one per line
+	stopwordsPath := flag.String("stopwords", "", "file with stopwords to exclude from the count, one per line")
+	// Count the common english words of the built-in stopword list too, they are left out by default
+	noBuiltinStopwords := flag.Bool("no-builtin-stopwords", false, "count the common english words of the built-in stopword list instead of excluding them")
+	// Site specific words (e.g. engadget, advertisement) to never count, even if they are in the word bank
+	excludeWords := stringsFlag{}
+	flag.Var(&excludeWords, "exclude", "word to exclude from the count, can be repeated")
+	excludeFile := flag.String("exclude-file", "", "file with words to exclude from the count, one per line")
+	// File to write the essays that failed to fetch or parse to as JSON
+	errorsOut := flag.String("errors-out", "", "file to write the essays that failed to fetch or parse to as JSON")
+	// How long the cached word bank on disk is used before it is downloaded again
+	wordBankTTL := flag.Duration("wordbank-ttl", 24*time.Hour, "how long the cached word bank is valid for")
+	// Timeout of the whole word bank download, which is a few MB so it gets longer than an essay request
+	wordBankTimeout := flag.Duration("wordbank-timeout", 2*time.Minute, "timeout for each attempt at downloading the word bank")
+	// Ignore the cached word bank and download it again
+	refreshWordBank := flag.Bool("refresh-wordbank", false, "force a re-download of the word bank")
+	// Count every word matching the regex, for jargon heavy essays with many words the word bank doesn't have
+	noBank := flag.Bool("no-bank", false, "count every word that matches the length rules instead of only words in the word bank")
+	// Exit when the word bank can't be downloaded instead of using the much smaller embedded word bank
+	noFallback := flag.Bool("no-fallback", false, "exit if the word bank download fails instead of using the embedded fallback")
+	// Checkpoint file to save progress to and resume an interrupted run from
+	checkpointPath := flag.String("checkpoint", "", "file to save progress to every -checkpoint-every essays, and resume from")
+	checkpointEvery := flag.Int("checkpoint-every", 100, "number of counted essays between checkpoints")
+	// Cache the fetched essay HTML on disk so re-runs count the cached pages instead of fetching them again
+	htmlCache := flag.String("html-cache", "", "directory to cache fetched essay HTML in, re-runs count the cached HTML instead of fetching it")
+	htmlCacheTTL := flag.Duration("html-cache-ttl", 7*24*time.Hour, "how long cached essay HTML is used before the essay is fetched again")
+	// Save the counts of every word after the run, and sort saved counts again instead of fetching the essays
+	saveCounts := flag.String("save-counts", "", "file to save the counts of every word to after the run, for -load-counts")
+	loadCounts := flag.String("load-counts", "", "sort the counts saved with -save-counts instead of fetching the essays")
+	// Write the top words so far as a JSON line every interval, for streaming consumers like a live dashboard
+	stream := flag.Duration("stream", 0, "write the top words so far as a JSON line to stdout every interval, e.g. 5s")
+	// Query the counted words from stdin once the result is written
+	interactive := flag.Bool("interactive", false, "after the run, read words and commands (top N, quit) from stdin to query the counts")
+	// Decimal places of the percentages, scores and other floats in the output
+	precision := flag.Int("precision", 4, "decimal places of the floats in the output (percent, score), -1 for full precision")
+	// Write the JSON output on a single line instead of indented
+	compact := flag.Bool("compact", false, "write the JSON output on a single line instead of indented")
+	// Check the JSON output decodes back into Output before it's written, to catch a broken output shape in a pipeline
+	validate := flag.Bool("validate", false, "check the JSON output round-trips through Output before writing it")
+	// Sort the top words by count or by word length, e.g. to find the longest frequent words
+	sortBy := flag.String("sort", "count", "what the top words are sorted by, count or length (then count)")
+	// Also output the top words within each group of words, e.g. the top words for each starting letter
+	groupBy := flag.String("group-by", "none", "also output the top words of each group of words: none, first-letter or length")
+	// Output the least common words instead of the most common
+	order := flag.String("order", "desc", "order of the top words, desc for the most common or asc for the least common")
+	// Rank the top words by raw count or by TF-IDF
+	rank := flag.String("rank", "count", "how to rank the top words, count or tfidf")
+	// Normalize the scores so long essays don't dominate, by the number of essays a word is in or per 1000 words
+	normalize := flag.String("normalize", "none", "normalize word scores: none, essay (average count per essay it's in) or per-1000 (per 1000 words, averaged over all essays)")
+	// Weight the words of newer essays more, halving the weight of an essay every half-life of age
+	recencyWeight := flag.Duration("recency-weight", 0, "half-life of the weight of an essay's words by its datePublished, e.g. 720h, 0 to not weight")
+	// Measure essay ages from this date instead of now, e.g. the newest essay of an old corpus
+	recencyFrom := flag.String("recency-from", "", "date essay ages are measured from for -recency-weight, e.g. 2019-08-31, defaults to now")
+	// What to do with essays that have invalid UTF-8, which would otherwise split the words it's in
+	invalidUTF8 := flag.String("invalid-utf8", "sanitize", "how to handle essays with invalid UTF-8, sanitize (replace it) or skip")
+	// Count phrases of N consecutive valid words instead of single words
+	ngram := flag.Int("ngram", 1, "count phrases of N consecutive valid words (2 for bigrams) instead of single words")
+	// ld+json keys the essay body is read from, for sites that don't use articleBody
+	bodyField := flag.String("body-field", "articleBody", "comma-separated ld+json keys to read the essay body from, tried in order")
+	// Count the paragraph text of pages that have no ld+json articleBody instead of skipping them
+	textFallback := flag.Bool("text-fallback", false, "count the <p> text of pages without an ld+json articleBody")
+	// Count plural and inflected forms of a word together under its stem
+	stem := flag.Bool("stem", false, "count the stem of each word so plural and inflected forms are counted together")
+	// Essays with fewer valid words than this are left out, they are usually not an article or a degraded page
+	minEssayWords := flag.Int("min-essay-words", 0, "leave essays with fewer than this many valid words out of the count")
+	// Words that appear fewer times than this across all essays are left out of the top words
+	minCount := flag.Int("min-count", 0, "leave words that appear fewer than this many times out of the top words")
+	// Every word that makes up at least this share of all valid words, for corpora of any size instead of a fixed top
+	minFreqPercent := flag.Float64("min-freq-percent", 0, "also output every word that makes up at least this percent of all valid words, e.g. 0.1, 0 for none")
+	// How the workers merge the counts, the alternatives to the default mutex are there to compare, see BenchmarkMerge
+	merge := flag.String("merge", "mutex", "how the workers merge each essay's words into the counts: mutex, sync-map or sharded")
+	// Expected number of distinct words, a few percent of the word bank size is a good guess for a large run
+	mapHint := flag.Int("map-hint", 0, "expected number of distinct words, used to size the word map up front")
+	// Exit with ExitRateLimited when more essays than this were rate limited, so automation can retry the job later
+	rateLimitThreshold := flag.Int("rate-limit-threshold", -1, "exit with code 3 if more than this many essays were rate limited, -1 to never")
+	// Exit with ExitNoWords when fewer valid words than this were counted, so a run where everything failed isn't a success
+	minTotalWords := flag.Int("min-total-words", 1, "exit with code 4 if fewer than this many valid words were counted in total, 0 to never")
+	// Treat essay redirects as failures instead of following them
+	noFollowRedirects := flag.Bool("no-follow-redirects", false, "fail essays that redirect instead of following the redirect")
+	// Add the peak goroutines and heap of the run to the summary, to size the number of workers, and word length stats
+	stats := flag.Bool("stats", false, "add the peak goroutines and heap of the run and the length stats of the valid words to the summary")
+	// One log line per essay as it completes, noisier than the progress but shows which pages are slow or empty
+	trace := flag.Bool("trace", false, "log a line for every essay with its status, bytes, fetch and parse time and valid words")
+	// Profiles of the whole run, to measure the counting pipeline with go tool pprof
+	cpuProfile := flag.String("cpuprofile", "", "write a CPU profile of the run to this file")
+	memProfile := flag.String("memprofile", "", "write a heap profile to this file at the end of the run")
+	// JSON file of flag values, to keep the settings of a run in version control instead of a long command line
+	configPath := flag.String("config", "", "JSON file of flag values keyed by flag name, flags given on the command line override it")
+	// Level of the logs written to stderr, the result itself is never logged
+	logLevel := flag.String("log-level", "info", "log level, one of error, warn, info or debug")
+	flag.Parse()
+
+	if *configPath != "" {
+		if err := applyConfigFile(flag.CommandLine, *configPath); err != nil {
+			fatal("Failed to load config", "path", *configPath, "error", err)
 		}
-		essayBatch = append(essayBatch, (*essays)[i:endBatch])
 	}
 
-	// Fetch essays concurrently, 1000 at a time, then wait for all to finish then process next batch
-	for i, batch := range essayBatch {
-		// Wait group will have length max 1000 at a time, wait for all to finish before proceeding to next batch
-		var wg sync.WaitGroup
-		wg.Add(len(batch))
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fatal("-log-level must be one of error, warn, info or debug", "log_level", *logLevel)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
 
-		//mutex is needed so we can write to our hashmap concurrently without issues
-		mtx := sync.Mutex{}
+	if *top <= 0 {
+		fatal("-top must be a positive number", "top", *top)
+	}
 
-		// Loop over essay URL, fetch Essay and extract valid words from each essay. Then check if the valid words is within the word bank
-		for _, essayUrl := range batch {
-			go func(essayUrl string) {
-				defer wg.Done()
-				words := fetchWordsFromEssay(essayUrl, wordBank, regExpression)
+	// with -workers auto the number of workers goes up to -max-workers, which is what the connections are sized for
+	autoWorkers := *workersFlag == "auto"
+	workers := *maxWorkers
+	if !autoWorkers {
+		var err error
+		workers, err = strconv.Atoi(*workersFlag)
+		if err != nil {
+			fatal("-workers must be a number or auto", "workers", *workersFlag)
+		}
+	}
+	if workers <= 0 {
+		fatal("-workers and -max-workers must be positive numbers", "workers", *workersFlag, "max_workers", *maxWorkers)
+	}
+
+	if *deterministic && (autoWorkers || *workersFlag != strconv.Itoa(wordcounter.DefaultWorkers)) {
+		slog.Warn("-workers is ignored with -deterministic, essays are fetched by a single worker")
+	}
+
+	if *timeout <= 0 {
+		fatal("-timeout must be a positive duration", "timeout", *timeout)
+	}
+
+	if *wordBankTimeout <= 0 {
+		fatal("-wordbank-timeout must be a positive duration", "wordbank_timeout", *wordBankTimeout)
+	}
+
+	if *maxBodySize < 0 {
+		fatal("-max-body-size must not be negative", "max_body_size", *maxBodySize)
+	}
+
+	if *maxIdleConnsPerHost < 0 || *maxConnsPerHost < 0 || *idleConnTimeout < 0 {
+		fatal("-max-idle-conns-per-host, -max-conns-per-host and -idle-conn-timeout must not be negative")
+	}
+	if *maxIdleConnsPerHost == 0 {
+		*maxIdleConnsPerHost = workers
+	}
+
+	if *maxRetries < 0 {
+		fatal("-max-retries must not be negative", "max_retries", *maxRetries)
+	}
+
+	if *networkRetries < 0 {
+		fatal("-network-retries must not be negative", "network_retries", *networkRetries)
+	}
+
+	if *minDelay < 0 || *maxDelay < *minDelay {
+		fatal("-min-delay must not be negative and -max-delay must be at least -min-delay", "min_delay", *minDelay, "max_delay", *maxDelay)
+	}
+
+	if *rps < 0 {
+		fatal("-rps must not be negative", "rps", *rps)
+	}
+	if *serveMaxBody < 0 || *serveMaxUrls < 0 {
+		fatal("-serve-max-body and -serve-max-urls must not be negative", "serve_max_body", *serveMaxBody,
+			"serve_max_urls", *serveMaxUrls)
+	}
+
+	if *format != "json" && *format != "csv" && *format != "table" {
+		fatal("-format must be one of json, csv or table", "format", *format)
+	}
+
+	if *perEssay && *format != "json" {
+		fatal("-per-essay is only supported with -format json")
+	}
 
-				mtx.Lock()
-				processEssay(&wordMap, words)
-				mtx.Unlock()
-			}(essayUrl)
+	if *byCategory && *format != "json" {
+		fatal("-by-category is only supported with -format json")
+	}
+
+	if *checkpointEvery <= 0 {
+		fatal("-checkpoint-every must be a positive number", "checkpoint_every", *checkpointEvery)
+	}
+
+	if *histogram && *format != "json" {
+		fatal("-histogram is only supported with -format json")
+	}
+
+	if *htmlCacheTTL <= 0 {
+		fatal("-html-cache-ttl must be positive", "html_cache_ttl", *htmlCacheTTL)
+	}
+
+	if *stream < 0 {
+		fatal("-stream must not be negative", "stream", *stream)
+	}
+
+	if *stream > 0 && *format != "json" {
+		fatal("-stream is only supported with -format json")
+	}
+
+	// streamed output is newline-delimited JSON, so the final result has to be on one line as well
+	if *stream > 0 {
+		*compact = true
+	}
+
+	if *loadCounts != "" && *saveCounts != "" {
+		fatal("-save-counts can't be used with -load-counts, the counts are already saved")
+	}
+
+	if *loadCounts != "" && (*perEssay || *byCategory || *stream > 0 || *dryRun) {
+		fatal("-per-essay, -by-category, -stream and -dry-run can't be used with -load-counts, no essays are counted")
+	}
+
+	if *interactive && *dryRun {
+		fatal("-interactive can't be used with -dry-run, nothing is counted")
+	}
+
+	if *precision < -1 {
+		fatal("-precision must be at least -1", "precision", *precision)
+	}
+
+	if *compact && *format != "json" {
+		fatal("-compact is only supported with -format json")
+	}
+
+	if *validate && *format != "json" {
+		fatal("-validate is only supported with -format json")
+	}
+
+	if *invalidUTF8 != "sanitize" && *invalidUTF8 != "skip" {
+		fatal("-invalid-utf8 must be one of sanitize or skip", "invalid_utf8", *invalidUTF8)
+	}
+
+	if *sortBy != string(wordcounter.SortCount) && *sortBy != string(wordcounter.SortLength) {
+		fatal("-sort must be one of count or length", "sort", *sortBy)
+	}
+
+	if *groupBy != string(wordcounter.GroupNone) && *groupBy != string(wordcounter.GroupFirstLetter) && *groupBy != string(wordcounter.GroupLength) {
+		fatal("-group-by must be one of none, first-letter or length", "group_by", *groupBy)
+	}
+
+	if *groupBy != string(wordcounter.GroupNone) && *format != "json" {
+		fatal("-group-by is only supported with -format json")
+	}
+
+	if *order != string(wordcounter.OrderDesc) && *order != string(wordcounter.OrderAsc) {
+		fatal("-order must be one of desc or asc", "order", *order)
+	}
+
+	if *rank != string(wordcounter.RankCount) && *rank != string(wordcounter.RankTfidf) {
+		fatal("-rank must be one of count or tfidf", "rank", *rank)
+	}
+
+	if *normalize != string(wordcounter.NormalizeNone) && *normalize != string(wordcounter.NormalizeEssay) && *normalize != string(wordcounter.NormalizePer1000) {
+		fatal("-normalize must be one of none, essay or per-1000", "normalize", *normalize)
+	}
+
+	if *recencyWeight < 0 {
+		fatal("-recency-weight must not be negative", "recency_weight", *recencyWeight)
+	}
+
+	recencyNow := time.Now()
+	if *recencyFrom != "" {
+		var err error
+		recencyNow, err = time.Parse(time.DateOnly, *recencyFrom)
+		if err != nil {
+			fatal("-recency-from must be a date like 2019-08-31", "recency_from", *recencyFrom, "error", err)
 		}
-		wg.Wait()
-		log.Println("Finished batch", i+1, "out of", len(essayBatch))
 	}
 
-	wordMap = *sortWordMap(&wordMap)
+	var bodyFields []string
+	for _, field := range strings.Split(*bodyField, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			bodyFields = append(bodyFields, field)
+		}
+	}
+	if len(bodyFields) == 0 {
+		fatal("-body-field must name at least one ld+json key", "body_field", *bodyField)
+	}
 
-	prettyJson, err := json.MarshalIndent(wordMap, "", "  ")
-	if err != nil {
-		log.Fatal(err)
+	if *ngram < 1 {
+		fatal("-ngram must be at least 1", "ngram", *ngram)
 	}
 
-	log.Println(string(prettyJson))
-}
+	if *minEssayWords < 0 {
+		fatal("-min-essay-words must not be negative", "min_essay_words", *minEssayWords)
+	}
 
-/*
-Fetch the wordbank from URL given, this is a list of all words that are valid.
-However they may be words in this list invalidated by regex rules as part of word validations
-*/
-func getWordBank(url string) *map[string]struct{} {
-	wordBank := map[string]struct{}{}
-	req, err := http.NewRequest("GET", url, nil)
+	if *minCount < 0 {
+		fatal("-min-count must not be negative", "min_count", *minCount)
+	}
+
+	if *minFreqPercent < 0 || *minFreqPercent > 100 {
+		fatal("-min-freq-percent must be between 0 and 100", "min_freq_percent", *minFreqPercent)
+	}
+
+	if *minFreqPercent > 0 && *format != "json" {
+		fatal("-min-freq-percent is only supported with -format json")
+	}
+
+	if *minTotalWords < 0 {
+		fatal("-min-total-words must not be negative", "min_total_words", *minTotalWords)
+	}
+
+	if *merge != string(wordcounter.MergeMutex) && *merge != string(wordcounter.MergeSyncMap) && *merge != string(wordcounter.MergeSharded) {
+		fatal("-merge must be one of mutex, sync-map or sharded", "merge", *merge)
+	}
+
+	if *merge != string(wordcounter.MergeMutex) && (*checkpointPath != "" || *stream > 0 || *recencyWeight > 0 || *normalize == string(wordcounter.NormalizePer1000)) {
+		fatal("-checkpoint, -stream, -recency-weight and -normalize per-1000 need -merge mutex")
+	}
+
+	if *mapHint < 0 {
+		fatal("-map-hint must not be negative", "map_hint", *mapHint)
+	}
+
+	if *minLength < 1 {
+		fatal("-min-length must be at least 1", "min_length", *minLength)
+	}
+
+	// the text is searched for the next match until none is left, so a match has to take up at least one character
+	var tokenRe *regexp.Regexp
+	if *tokenRegex != "" {
+		var err error
+		tokenRe, err = regexp.Compile(*tokenRegex)
+		if err != nil {
+			fatal("-token-regex is not a valid regex", "token_regex", *tokenRegex, "error", err)
+		}
+		if tokenRe.MatchString("") {
+			fatal("-token-regex must not match an empty string", "token_regex", *tokenRegex)
+		}
+	}
+
+	// Profiles are stopped and written by defers, so they are skipped when a fatal error exits early
+	if *cpuProfile != "" {
+		stopCPUProfile, err := startCPUProfile(*cpuProfile)
+		if err != nil {
+			fatal("Failed to start CPU profile", "path", *cpuProfile, "error", err)
+		}
+		defer stopCPUProfile()
+	}
+	if *memProfile != "" {
+		defer writeMemProfile(*memProfile)
+	}
+
+	// Context is cancelled on Ctrl-C so in-flight requests are aborted and no new essays are picked up
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cfg := wordcounter.Config{
+		WordBanks:           wordBankSources,
+		NoBank:              *noBank,
+		NoFallback:          *noFallback,
+		WordBankTTL:         *wordBankTTL,
+		WordBankTimeout:     *wordBankTimeout,
+		RefreshWordBank:     *refreshWordBank,
+		StopwordsPath:       *stopwordsPath,
+		NoBuiltinStopwords:  *noBuiltinStopwords,
+		Exclude:             excludeWords,
+		ExcludeFile:         *excludeFile,
+		EssaysPath:          *essaysPath,
+		EssayDir:            *essayDir,
+		LimitEssays:         *limitEssays,
+		Sample:              *sample,
+		Seed:                *sampleSeed,
+		DryRun:              *dryRun,
+		Deterministic:       *deterministic,
+		Timeout:             *timeout,
+		MaxIdleConnsPerHost: *maxIdleConnsPerHost,
+		MaxConnsPerHost:     *maxConnsPerHost,
+		IdleConnTimeout:     *idleConnTimeout,
+		UserAgent:           *userAgent,
+		Headers:             http.Header(headers),
+		NoFollowRedirects:   *noFollowRedirects,
+		Workers:             workers,
+		AutoWorkers:         autoWorkers,
+		MaxRetries:          *maxRetries,
+		NetworkRetries:      *networkRetries,
+		MinDelay:            *minDelay,
+		MaxDelay:            *maxDelay,
+		RPS:                 *rps,
+		MaxBodySize:         *maxBodySize,
+		HTMLCache:           *htmlCache,
+		HTMLCacheTTL:        *htmlCacheTTL,
+		MinLength:           *minLength,
+		Unicode:             *unicodeWords,
+		TokenRegex:          tokenRe,
+		Top:                 *top,
+		MinCount:            *minCount,
+		MinFreqPercent:      *minFreqPercent,
+		MinEssayWords:       *minEssayWords,
+		Stem:                *stem,
+		TextFallback:        *textFallback,
+		BodyFields:          bodyFields,
+		Ngram:               *ngram,
+		SkipInvalidUTF8:     *invalidUTF8 == "skip",
+		Rank:                wordcounter.Rank(*rank),
+		Normalize:           wordcounter.Normalize(*normalize),
+		Order:               wordcounter.Order(*order),
+		Sort:                wordcounter.SortBy(*sortBy),
+		GroupBy:             wordcounter.GroupBy(*groupBy),
+		RecencyWeight:       *recencyWeight,
+		RecencyFrom:         recencyNow,
+		MapHint:             *mapHint,
+		Merge:               wordcounter.MergeMode(*merge),
+		Checkpoint:          *checkpointPath,
+		CheckpointEvery:     *checkpointEvery,
+		SaveCounts:          *saveCounts,
+		LoadCounts:          *loadCounts,
+		PerEssay:            *perEssay,
+		ByCategory:          *byCategory,
+		Stats:               *stats,
+		Trace:               *trace,
+		Stream:              *stream,
+		ServeMaxBody:        *serveMaxBody,
+		ServeMaxUrls:        *serveMaxUrls,
+	}
+
+	if *interactive && cfg.ReadsStdin() {
+		fatal("-interactive reads queries from stdin, so it can't be used when the essays are read from stdin (-essays - or empty)")
+	}
+
+	// Each snapshot is a line of the same shape as the final output, which is the last line and the authoritative result
+	if *stream > 0 {
+		cfg.OnSnapshot = func(snapshot *wordcounter.Result) {
+			line, err := marshalOutput(Output{Version: OutputVersion, Words: snapshot.Words, Summary: snapshot.Summary}, true, *precision)
+			if err != nil {
+				slog.Warn("Failed to encode snapshot", "error", err)
+				return
+			}
+			fmt.Println(string(line))
+		}
+	}
+
+	// Serve mode runs the same pipeline for every request instead of the essays file
+	if *serve != "" {
+		if err := wordcounter.Serve(ctx, *serve, cfg); err != nil {
+			fatal("Server failed", "addr", *serve, "error", err)
+		}
+		return
+	}
+
+	result, err := wordcounter.Run(ctx, cfg)
+	if err != nil && result == nil {
+		fatal("Run failed", "error", err)
+	}
+	// a dry run stops once the inputs are checked, there is no result to write
+	if *dryRun {
+		return
+	}
+	interrupted := err != nil && ctx.Err() != nil
 	if err != nil {
-		log.Fatal(err)
+		slog.Warn("Run was interrupted, printing partial results")
+	}
+
+	if *errorsOut != "" {
+		failuresJson, err := json.MarshalIndent(result.Failures, "", "  ")
+		if err != nil {
+			fatal("Failed to encode failed essays", "error", err)
+		}
+		if err := os.WriteFile(*errorsOut, append(failuresJson, '\n'), 0644); err != nil {
+			fatal("Failed to write failed essays", "path", *errorsOut, "error", err)
+		}
+		slog.Info("Wrote failed essays", "failed", len(result.Failures), "path", *errorsOut)
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	jsonOutput := Output{Version: OutputVersion, Words: result.Words, FrequentWords: result.FrequentWords, Summary: result.Summary, Categories: result.Categories, Groups: result.Groups, Essays: result.Essays}
+	if *histogram {
+		jsonOutput.Histogram = result.Histogram
+	}
 
+	var output []byte
+	switch *format {
+	case "csv":
+		output, err = formatCsv(&result.Words, *precision)
+	case "table":
+		output, err = formatTable(&result.Words, *precision)
+	default:
+		output, err = marshalOutput(jsonOutput, *compact, *precision)
+		output = append(output, '\n')
+	}
 	if err != nil {
-		log.Fatal(err)
+		fatal("Failed to format result", "format", *format, "error", err)
 	}
 
-	defer resp.Body.Close()
+	if *validate {
+		if err := validateOutput(output, *compact); err != nil {
+			fatal("Output failed validation", "error", err)
+		}
+		slog.Debug("Output passed validation")
+	}
 
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		word := strings.ToLower(scanner.Text())
-		wordBank[word] = struct{}{}
+	// Logs go to stderr, so stdout only ever contains the result
+	if *out != "" {
+		if err := os.WriteFile(*out, output, 0644); err != nil {
+			fatal("Failed to write result", "path", *out, "error", err)
+		}
+		slog.Info("Wrote result", "path", *out)
+	} else {
+		fmt.Print(string(output))
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+	// Queries are answered on stdout after the result, the prompt goes to stderr so it's not mixed into a piped result
+	if *interactive {
+		if err := runInteractive(os.Stdin, os.Stdout, os.Stderr, result.Counts); err != nil {
+			fatal("Failed to read queries", "error", err)
+		}
 	}
 
-	return &wordBank
+	// The partial result is still written so it can be used, but a wrapper mustn't take it for a complete run
+	if interrupted {
+		os.Exit(ExitInterrupted)
+	}
+
+	// The result is still written so it can be used, the exit code tells a wrapper it's degraded and worth retrying later
+	if *rateLimitThreshold >= 0 && result.Summary.EssaysRateLimited > *rateLimitThreshold {
+		slog.Error("Too many essays were rate limited", "rate_limited", result.Summary.EssaysRateLimited,
+			"threshold", *rateLimitThreshold)
+		os.Exit(ExitRateLimited)
+	}
+
+	// An empty result is still written, but it's most likely because every essay failed rather than a corpus without
+	// any valid words
+	if result.Summary.TotalWords < *minTotalWords {
+		slog.Error("Too few valid words were counted", "total_words", result.Summary.TotalWords,
+			"min_total_words", *minTotalWords, "essays_processed", result.Summary.EssaysProcessed,
+			"essays_failed", result.Summary.EssaysFailed)
+		os.Exit(ExitNoWords)
+	}
+}
+
+// Marshal the JSON output indented for humans, or on a single line with compact e.g. for a log aggregator. Words are a
+// slice so their order is kept either way. Floats are rounded to precision decimal places here rather than as they
+// are counted, so the rounding errors don't add up, a negative precision keeps them as they are
+func marshalOutput(output Output, compact bool, precision int) ([]byte, error) {
+	output = roundOutput(output, precision)
+	if compact {
+		return json.Marshal(output)
+	}
+	return json.MarshalIndent(output, "", "  ")
 }
 
-// Read local file for list of URLs containing articles/essays
-func getEssays(filePath string) *[]string {
-	var essays []string
+// Round the float fields of the output to precision decimal places, a negative precision leaves them as they are. The
+// words are copied so the result they came from keeps its full precision
+func roundOutput(output Output, precision int) Output {
+	if precision < 0 {
+		return output
+	}
 
-	// Fetch from local file
-	f, err := os.ReadFile(filePath)
-	if err != nil {
-		log.Fatal(err)
+	output.Words = roundWords(output.Words, precision)
+	if output.FrequentWords != nil {
+		output.FrequentWords = roundWords(output.FrequentWords, precision)
+	}
+	if output.Categories != nil {
+		categories := make(map[string][]wordcounter.WordCount, len(output.Categories))
+		for category, words := range output.Categories {
+			categories[category] = roundWords(words, precision)
+		}
+		output.Categories = categories
 	}
+	if output.Groups != nil {
+		groups := make(map[string][]wordcounter.WordCount, len(output.Groups))
+		for group, words := range output.Groups {
+			groups[group] = roundWords(words, precision)
+		}
+		output.Groups = groups
+	}
+	if output.Essays != nil {
+		essays := make(map[string][]wordcounter.WordCount, len(output.Essays))
+		for essayUrl, words := range output.Essays {
+			essays[essayUrl] = roundWords(words, precision)
+		}
+		output.Essays = essays
+	}
+	if output.Summary.WordStats != nil {
+		wordStats := *output.Summary.WordStats
+		wordStats.AverageLength = roundFloat(wordStats.AverageLength, precision)
+		output.Summary.WordStats = &wordStats
+	}
+
+	return output
+}
 
-	essays = strings.Split(string(f), "\n")
+func roundWords(words []wordcounter.WordCount, precision int) []wordcounter.WordCount {
+	rounded := slices.Clone(words)
+	for i := range rounded {
+		rounded[i].Percent = roundFloat(rounded[i].Percent, precision)
+		rounded[i].Score = roundFloat(rounded[i].Score, precision)
+	}
+	return rounded
+}
 
-	return &essays
+func roundFloat(f float64, precision int) float64 {
+	scale := math.Pow(10, float64(precision))
+	return math.Round(f*scale) / scale
 }
 
-// Fetch all valid words from the articleBody in essay HTML
-func fetchWordsFromEssay(essayUrl string, wordBank *map[string]struct{}, regExpression *regexp.Regexp) *[]string {
-	// sleep for random amount of time between 200-1000 msec to avoid being rate limited
-	time.Sleep(time.Duration(rand.Intn(800)+200) * time.Millisecond)
+/*
+Check the marshalled JSON output decodes into Output without any unknown fields, has the current version and encodes
+back to the same JSON, so a field that doesn't round-trip (a missing or mistyped json tag) is caught before the
+output reaches a consumer
+*/
+func validateOutput(output []byte, compact bool) error {
+	decoder := json.NewDecoder(bytes.NewReader(output))
+	decoder.DisallowUnknownFields()
+
+	var decoded Output
+	if err := decoder.Decode(&decoded); err != nil {
+		return fmt.Errorf("output does not decode: %w", err)
+	}
+	if decoded.Version != OutputVersion {
+		return fmt.Errorf("output has version %d, expected %d", decoded.Version, OutputVersion)
+	}
+	// a run that counted nothing has an empty words array, but the array itself must be there
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(output, &fields); err != nil {
+		return fmt.Errorf("output does not decode: %w", err)
+	}
+	if words, ok := fields["words"]; !ok || !bytes.HasPrefix(words, []byte("[")) {
+		return errors.New("output has no words array")
+	}
 
-	var validEssayWords []string
-	req, err := http.Get(essayUrl)
+	// the decoded floats are already rounded
+	roundTrip, err := marshalOutput(decoded, compact, -1)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if !bytes.Equal(append(roundTrip, '\n'), output) {
+		return errors.New("output changes when decoded and encoded again")
 	}
 
-	defer req.Body.Close()
+	return nil
+}
+
+// Format the sorted words as csv with a header row, the rank is included as the first column
+func formatCsv(topWords *[]wordcounter.WordCount, precision int) ([]byte, error) {
+	var buf strings.Builder
+	w := csv.NewWriter(&buf)
 
-	htmlFile, err := html.Parse(req.Body)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Traverse the html nodes and get the articleBody that is inside <script type="application/ld+json">
-	var f func(*html.Node)
-	f = func(n *html.Node) {
-		if n.Type == html.ElementNode && n.Data == "script" {
-			for _, a := range n.Attr {
-				if a.Key == "type" && a.Val == "application/ld+json" {
-					// Parse the json and get the articleBody by marshalling it into a map
-					var m map[string]interface{}
-					err := json.Unmarshal([]byte(n.FirstChild.Data), &m)
-					if err != nil {
-						log.Fatal(err)
-					}
-
-					if _, ok := m["articleBody"]; !ok {
-						log.Println("articleBody not found in", essayUrl)
-						return
-					}
-
-					articleBody := m["articleBody"].(string)
-					essayWords := regExpression.FindAllString(articleBody, -1)
-					for _, word := range essayWords {
-						if _, ok := (*wordBank)[word]; ok {
-							validEssayWords = append(validEssayWords, word)
-						}
-					}
-				}
-			}
-		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			f(c)
+	if err := w.Write([]string{"rank", "word", "count", "doc_freq", "percent"}); err != nil {
+		return nil, err
+	}
+	for i, wordCount := range *topWords {
+		record := []string{strconv.Itoa(i + 1), wordCount.Word, strconv.Itoa(wordCount.Count), strconv.Itoa(wordCount.DocFreq),
+			strconv.FormatFloat(wordCount.Percent, 'f', precision, 64)}
+		if err := w.Write(record); err != nil {
+			return nil, err
 		}
 	}
-	f(htmlFile)
 
-	// if validEssayWords is empty, then we are likely being ratelimited
-	if len(validEssayWords) == 0 {
-		log.Println("No words found in", essayUrl, "likely being rate limited")
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
 	}
 
-	return &validEssayWords
+	return []byte(buf.String()), nil
 }
 
-// Update the wordMap with list of validated words within essay. wordMap key are valid words and value is the count
-func processEssay(wordMap *map[string]int, words *[]string) {
-	for _, word := range *words {
-		(*wordMap)[word]++
+// Format the sorted words as an aligned text table for the terminal, the rank is included as the first column
+func formatTable(topWords *[]wordcounter.WordCount, precision int) ([]byte, error) {
+	var buf strings.Builder
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "RANK\tWORD\tCOUNT\tESSAYS\tPERCENT")
+	for i, wordCount := range *topWords {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s%%\n", i+1, wordCount.Word, wordCount.Count, wordCount.DocFreq,
+			strconv.FormatFloat(wordCount.Percent, 'f', precision, 64))
 	}
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return []byte(buf.String()), nil
 }
 
-// Sort wordMap by value and return only top 10
-func sortWordMap(wordMap *map[string]int) *map[string]int {
-	var wordMapSlice []WordCount
-	for k, v := range *wordMap {
-		wordMapSlice = append(wordMapSlice, WordCount{k, v})
-	}
-
-	/* a custom sorting algorithm can be used here to sort by value considering it will use builtins instead,
-	however the underlying logic would be the same so this is fine for purposes of the exercise */
-	sort.Slice(wordMapSlice, func(i, j int) bool {
-		return wordMapSlice[i].Count > wordMapSlice[j].Count
-	})
-
-	// get top 10 only
-	sortedWordMap := make(map[string]int, 10)
-	for i, wordCount := range wordMapSlice {
-		sortedWordMap[wordCount.Word] = wordCount.Count
-		if i == 9 {
-			break
+// Start profiling the CPU to the file at path, the returned function stops the profile and closes the file
+func startCPUProfile(path string) (func(), error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pprof.StartCPUProfile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return func() {
+		pprof.StopCPUProfile()
+		if err := file.Close(); err != nil {
+			slog.Warn("Failed to write CPU profile", "path", path, "error", err)
+			return
 		}
+		slog.Info("Wrote CPU profile", "path", path)
+	}, nil
+}
+
+// Write a heap profile to the file at path, after a GC so it shows the memory still in use at the end of the run
+func writeMemProfile(path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		slog.Warn("Failed to create heap profile", "path", path, "error", err)
+		return
 	}
+	defer file.Close()
 
-	return &sortedWordMap
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(file); err != nil {
+		slog.Warn("Failed to write heap profile", "path", path, "error", err)
+		return
+	}
+	slog.Info("Wrote heap profile", "path", path)
 }
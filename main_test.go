@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"top-10-essay-word-counter/wordcounter"
+)
+
+// A run that counted no words still writes valid output, an empty words array rather than null
+func TestValidateOutputNoWords(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		output := Output{Version: OutputVersion, Words: wordcounter.TopWords(map[string]int{}, 10)}
+		marshalled, err := marshalOutput(output, compact, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := validateOutput(append(marshalled, '\n'), compact); err != nil {
+			t.Errorf("validateOutput() of no words (compact %t) error = %v", compact, err)
+		}
+	}
+
+	marshalled, err := marshalOutput(Output{Version: OutputVersion}, true, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateOutput(append(marshalled, '\n'), true); err == nil {
+		t.Error("validateOutput() of null words error = nil, want an error")
+	}
+}
@@ -0,0 +1,77 @@
+package wordcounter
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// State of a run written to the checkpoint file, so an interrupted run can resume without re-fetching every essay
+type checkpoint struct {
+	WordMap map[string]int `json:"word_map"`
+	DocFreq map[string]int `json:"doc_freq"`
+	// weighted counts, written whenever the essays are weighted (see weightsEssays): with WithRecencyWeight and with
+	// WithNormalize(NormalizePer1000), which keeps each word's counts per 1000 words here. Resuming either needs them
+	Weighted map[string]float64 `json:"weighted,omitempty"`
+	// essays that were counted successfully, failed essays are not included so they are retried on resume
+	Completed []string `json:"completed"`
+}
+
+// Load the checkpoint file, a missing file is not an error and returns an empty checkpoint
+func loadCheckpoint(path string) (*checkpoint, error) {
+	cp := &checkpoint{WordMap: make(map[string]int), DocFreq: make(map[string]int)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, err
+	}
+	if cp.WordMap == nil {
+		cp.WordMap = make(map[string]int)
+	}
+	// checkpoints written before document frequencies were tracked don't have them
+	if cp.DocFreq == nil {
+		cp.DocFreq = make(map[string]int)
+	}
+
+	return cp, nil
+}
+
+// Load counts saved with WithSaveCounts, unlike a checkpoint the file has to exist
+func loadSavedCounts(path string) (*checkpoint, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return loadCheckpoint(path)
+}
+
+// Write the checkpoint to a temp file and move it into place, so a crash while writing never corrupts the last checkpoint
+func writeCheckpoint(path string, cp *checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,2244 @@
+/*
+Package wordcounter fetches essays concurrently and counts the valid words in the ld+json articleBody of each, the
+words that pass the word bank, stopwords and regex. NewWordCounter and its options count a list of essay URLs (or
+essay HTML from readers), Run runs the whole pipeline of the command line from a Config and Serve serves it over HTTP.
+*/
+package wordcounter
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/time/rate"
+)
+
+// Number of workers fetching essays at once unless WithWorkers says otherwise
+const DefaultWorkers = 50
+
+// Essay bodies larger than this are skipped unless WithMaxBodySize says otherwise
+const DefaultMaxBodySize = 10 << 20
+
+// Returned (wrapped) by fetchWordsFromEssay when the essay could not be fetched because we kept being rate limited
+var ErrRateLimited = errors.New("rate limited")
+
+// Returned by fetchWordsFromEssay when none of the ld+json blocks in the essay have an articleBody
+var ErrNoArticleBody = errors.New("articleBody not found")
+
+// Returned (wrapped) by fetchWordsFromEssay when an ld+json block in the essay is not valid json
+var ErrParse = errors.New("failed to parse ld+json")
+
+// Returned by fetchWordsFromEssay when an ld+json block has invalid UTF-8 and WithSkipInvalidUTF8 is set
+var ErrInvalidUTF8 = errors.New("invalid UTF-8 in ld+json")
+
+// Returned (wrapped) when an essay redirects and following redirects is turned off with WithFollowRedirects(false)
+var ErrRedirected = errors.New("redirected")
+
+// Returned (wrapped) when counting an essay panicked, the panic is recovered so only that essay fails
+var ErrPanic = errors.New("panic while counting essay")
+
+// Returned when an essay body is larger than the limit set with WithMaxBodySize
+var ErrBodyTooLarge = errors.New("essay body too large")
+
+// Returned (wrapped) when an essay responds with a status code other than 200
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+}
+
+// An essay that failed to be fetched or parsed, written to -errors-out so the failed URLs can be re-run
+type EssayFailure struct {
+	URL    string `json:"url"`
+	Reason string `json:"reason"`
+	Error  string `json:"error"`
+}
+
+/*
+WordCounter fetches essays and counts the valid words in them, it holds the word bank, the regex that tokenizes the
+essays, the concurrency settings and the HTTP client used for fetching. Create one with NewWordCounter.
+*/
+type WordCounter struct {
+	client        *http.Client
+	bank          *wordBankState
+	stopwords     *map[string]struct{}
+	excluded      *map[string]struct{}
+	regExpression *regexp.Regexp
+	workers       int
+	maxRetries    int
+	// most workers fetching at once with WithAdaptiveWorkers, 0 for a fixed number of workers
+	maxAdaptiveWorkers int
+	// immediate retries of a request that failed with a transient network error
+	networkRetries int
+	headers        http.Header
+	top            int
+	minCount       int
+	// share of all valid words in percent a word needs for the frequent words, 0 for none
+	minFreqPercent float64
+	minEssayWords  int
+	stem           bool
+	textFallback   bool
+	// ld+json keys the body is read from, the first one an object has wins
+	bodyFields []string
+	ngram      int
+	// fail essays with invalid UTF-8 instead of replacing the invalid bytes
+	skipInvalidUTF8 bool
+	rank            Rank
+	order           Order
+	normalize       Normalize
+	sortBy          SortBy
+	groupBy         GroupBy
+	// half-life of the recency weight of an essay's words and the time its age is measured from, 0 to not weight
+	recencyHalfLife time.Duration
+	recencyNow      time.Time
+	mapHint         int
+	// essay bodies larger than this many bytes are skipped, 0 for no limit
+	maxBodySize int64
+	minDelay    time.Duration
+	maxDelay    time.Duration
+	limiter     *rate.Limiter
+
+	// checkpoint file the counts are saved to every checkpointEvery counted essays, and resumed from on start
+	checkpointPath  string
+	checkpointEvery int
+	// file the full counts are saved to once the run ends, in the checkpoint format
+	countsPath string
+	// directory the fetched essay HTML is cached in and how long it's used for instead of fetching the essay again
+	htmlCacheDir string
+	htmlCacheTTL time.Duration
+
+	// used to build the regex and client in NewWordCounter, unless they are given directly
+	minWordLength    int
+	unicodeWords     bool
+	timeout          time.Duration
+	noFollowRedirect bool
+	transport        http.RoundTripper
+
+	wordBankLoader func() (*map[string]struct{}, error)
+
+	// add the length statistics of the valid words to the summary
+	wordStats bool
+	// log a line for every essay once it's done, see traceEssay
+	trace bool
+
+	// how the words of each essay are merged into the corpus counts
+	mergeMode MergeMode
+
+	// category of each essay URL, the words of an essay with a category are also counted for its category
+	categories map[string]string
+
+	// progress lines are written here instead of being logged when it's set
+	progressWriter io.Writer
+
+	// called for every word whose total count reaches one of countThresholds, sorted ascending
+	onThreshold     func(WordCount)
+	countThresholds []int
+
+	// called with the top words so far every snapshotInterval while essays are counted
+	onSnapshot       func(*Result)
+	snapshotInterval time.Duration
+
+	// called for every essay that failed or was counted, one call at a time from the worker goroutines
+	onFailure func(EssayFailure)
+	onEssay   func(essayUrl string, essayWordMap map[string]int)
+
+	// Prometheus metrics of the essay fetches, only set in serve mode
+	metrics *metrics
+}
+
+// Word bank shared by a WordCounter and its copies, words and err are only set once ready is closed when it's loaded
+// with WithWordBankLoader
+type wordBankState struct {
+	ready    chan struct{}
+	words    *map[string]struct{}
+	err      error
+	loadTime time.Duration
+}
+
+// Wait for the word bank to be loaded and return it
+func (wc *WordCounter) wordBank() *map[string]struct{} {
+	<-wc.bank.ready
+	return wc.bank.words
+}
+
+// Wait for the word bank to be loaded and return the error it failed with, if any
+func (wc *WordCounter) waitForWordBank() error {
+	<-wc.bank.ready
+	if wc.bank.err != nil {
+		return fmt.Errorf("failed to load word bank: %w", wc.bank.err)
+	}
+	return nil
+}
+
+// Whether the word bank is loaded and failed, without waiting for it
+func (wc *WordCounter) wordBankFailed() bool {
+	select {
+	case <-wc.bank.ready:
+		return wc.bank.err != nil
+	default:
+		return false
+	}
+}
+
+// Option configures a WordCounter created with NewWordCounter
+type Option func(*WordCounter)
+
+// Load the word bank in the background with load instead of passing it to NewWordCounter, essays are fetched while it
+// loads and counting only waits for it when the first essay's words are checked. If load fails the essays stop being
+// fetched and Count returns its error
+func WithWordBankLoader(load func() (*map[string]struct{}, error)) Option {
+	return func(wc *WordCounter) {
+		wc.wordBankLoader = load
+	}
+}
+
+// Use the given HTTP client to fetch essays, defaults to a client with a 30s timeout
+func WithHTTPClient(client *http.Client) Option {
+	return func(wc *WordCounter) {
+		wc.client = client
+	}
+}
+
+// Timeout for every essay request, applied to a copy of the HTTP client so a client given with WithHTTPClient isn't
+// changed. Defaults to 30s
+func WithTimeout(timeout time.Duration) Option {
+	return func(wc *WordCounter) {
+		wc.timeout = timeout
+	}
+}
+
+// Transport the essay requests are made with, e.g. to serve canned essays without the network. Applied to a copy of
+// the HTTP client like WithTimeout, defaults to the client's own transport
+func WithTransport(transport http.RoundTripper) Option {
+	return func(wc *WordCounter) {
+		wc.transport = transport
+	}
+}
+
+// Whether essay redirects are followed, defaults to true. When turned off a redirect fails the essay with
+// ErrRedirected, applied to a copy of the HTTP client like WithTimeout
+func WithFollowRedirects(follow bool) Option {
+	return func(wc *WordCounter) {
+		wc.noFollowRedirect = !follow
+	}
+}
+
+// Minimum number of characters in a valid word, defaults to 3. Ignored if WithRegexp is given
+func WithMinWordLength(minWordLength int) Option {
+	return func(wc *WordCounter) {
+		wc.minWordLength = minWordLength
+	}
+}
+
+// Match words with any unicode letters instead of only a-z, defaults to false. Ignored if WithRegexp is given
+func WithUnicode(unicodeWords bool) Option {
+	return func(wc *WordCounter) {
+		wc.unicodeWords = unicodeWords
+	}
+}
+
+// How the top words are ranked
+type Rank string
+
+const (
+	// Rank words by how many times they were counted across all essays
+	RankCount Rank = "count"
+	// Rank words by TF-IDF, so words that are distinctive to some essays rise above words used in every essay
+	RankTfidf Rank = "tfidf"
+)
+
+// How the top words are ranked, defaults to RankCount
+func WithRank(rank Rank) Option {
+	return func(wc *WordCounter) {
+		wc.rank = rank
+	}
+}
+
+// How the score of each word is normalized for the length and number of essays
+type Normalize string
+
+const (
+	// Don't normalize, words are scored by their total count
+	NormalizeNone Normalize = "none"
+	// Score words by their average count in the essays they appear in, the count divided by the document frequency
+	NormalizeEssay Normalize = "essay"
+	// Score words by their count per 1000 valid words of each essay, averaged over all the essays counted, so long
+	// essays don't outweigh short ones
+	NormalizePer1000 Normalize = "per-1000"
+)
+
+// Score and rank the words normalized, the normalized score is returned as their Score. Defaults to NormalizeNone,
+// with RankTfidf the normalized score takes the place of the count
+func WithNormalize(normalize Normalize) Option {
+	return func(wc *WordCounter) {
+		wc.normalize = normalize
+	}
+}
+
+/*
+Weight the words of each essay by how recent it is before the top words are ranked, so newer essays count more. The
+weight decays exponentially with the essay's age, 0.5^(age/halfLife), where age is how long before now the essay was
+published according to its ld+json datePublished. Essays without a parseable date, or dated after now, get a weight of
+1. The weighted count of each word is returned as its Score, and combined with RankTfidf it replaces the count in the
+TF-IDF scores. A halfLife of 0 turns weighting off
+*/
+func WithRecencyWeight(halfLife time.Duration, now time.Time) Option {
+	return func(wc *WordCounter) {
+		wc.recencyHalfLife = halfLife
+		wc.recencyNow = now
+	}
+}
+
+// Fail essays whose ld+json has invalid UTF-8 with ErrInvalidUTF8 instead of replacing the invalid bytes with U+FFFD,
+// defaults to false
+func WithSkipInvalidUTF8(skip bool) Option {
+	return func(wc *WordCounter) {
+		wc.skipInvalidUTF8 = skip
+	}
+}
+
+// Count phrases of n consecutive valid words instead of single words, e.g. 2 for bigrams, defaults to 1. Every word
+// of a phrase must pass the word bank and stopword checks
+func WithNgram(n int) Option {
+	return func(wc *WordCounter) {
+		wc.ngram = n
+	}
+}
+
+// ld+json keys to read the essay body from, tried in order so e.g. articleBody, text, description falls back to text
+// and then description for sites that don't use articleBody. Defaults to just articleBody, also when no fields are given
+func WithBodyFields(fields ...string) Option {
+	return func(wc *WordCounter) {
+		if len(fields) > 0 {
+			wc.bodyFields = fields
+		}
+	}
+}
+
+// Count the text of the page's <p> elements when it has no ld+json articleBody, instead of failing the essay with
+// ErrNoArticleBody. Defaults to false
+func WithTextFallback(textFallback bool) Option {
+	return func(wc *WordCounter) {
+		wc.textFallback = textFallback
+	}
+}
+
+// Order of the top words
+type Order string
+
+const (
+	// Most common (or highest scoring) words first
+	OrderDesc Order = "desc"
+	// Least common (or lowest scoring) words first, so the top words are the rarest ones
+	OrderAsc Order = "asc"
+)
+
+// Order of the top words, defaults to OrderDesc
+func WithOrder(order Order) Option {
+	return func(wc *WordCounter) {
+		wc.order = order
+	}
+}
+
+// What the top words are sorted by first
+type SortBy string
+
+const (
+	// Sort by count (or score), the most common words first
+	SortCount SortBy = "count"
+	// Sort by the length of the word in characters and then by count (or score), the longest words first
+	SortLength SortBy = "length"
+)
+
+// Sort key of the top words, defaults to SortCount. It decides which words are the top ones as well as their order,
+// so with SortLength the top words are the longest ones
+func WithSortBy(sortBy SortBy) Option {
+	return func(wc *WordCounter) {
+		wc.sortBy = sortBy
+	}
+}
+
+// How the words are partitioned for the top words of each group
+type GroupBy string
+
+const (
+	// Don't group the words, only the top words across all of them are picked
+	GroupNone GroupBy = "none"
+	// Group the words by their first letter
+	GroupFirstLetter GroupBy = "first-letter"
+	// Group the words by their length in characters
+	GroupLength GroupBy = "length"
+)
+
+// Also pick the top words within each group of words, e.g. the top 5 words for each starting letter, returned as
+// Result.Groups. Defaults to GroupNone
+func WithGroupBy(groupBy GroupBy) Option {
+	return func(wc *WordCounter) {
+		wc.groupBy = groupBy
+	}
+}
+
+// Count the stem of each valid word instead of the word itself so plural and inflected forms (cat and cats) are
+// counted together, defaults to false
+func WithStemming(stem bool) Option {
+	return func(wc *WordCounter) {
+		wc.stem = stem
+	}
+}
+
+// Number of worker goroutines fetching essays concurrently, defaults to DefaultWorkers
+func WithWorkers(workers int) Option {
+	return func(wc *WordCounter) {
+		wc.workers = workers
+	}
+}
+
+// Adapt the number of workers fetching at once to the rate limiting of the site instead of a fixed number, between 1
+// and maxWorkers, see adaptiveWorkers. Overrides WithWorkers, 0 or less keeps the fixed number of workers
+func WithAdaptiveWorkers(maxWorkers int) Option {
+	return func(wc *WordCounter) {
+		wc.maxAdaptiveWorkers = maxWorkers
+	}
+}
+
+// Site specific words (e.g. engadget, advertisement) that are never counted even if they are in the word bank, kept
+// apart from the stopwords so the common words list can be shared between sites. Words must be lowercase, defaults
+// to none
+func WithExclude(excluded *map[string]struct{}) Option {
+	return func(wc *WordCounter) {
+		wc.excluded = excluded
+	}
+}
+
+// Words that are never counted even if they are in the word bank, defaults to none
+func WithStopwords(stopwords *map[string]struct{}) Option {
+	return func(wc *WordCounter) {
+		wc.stopwords = stopwords
+	}
+}
+
+// Regex that matches candidate words in the articleBody, overrides WithMinWordLength and WithUnicode
+func WithRegexp(regExpression *regexp.Regexp) Option {
+	return func(wc *WordCounter) {
+		wc.regExpression = regExpression
+	}
+}
+
+// Random delay before every essay request is between minDelay and maxDelay, defaults to 200ms-1s. Both zero disables it
+func WithDelay(minDelay, maxDelay time.Duration) Option {
+	return func(wc *WordCounter) {
+		wc.minDelay = minDelay
+		wc.maxDelay = maxDelay
+	}
+}
+
+// Cap the number of essay requests per second across all workers, defaults to no limit. Zero or less disables it
+func WithRateLimit(requestsPerSecond float64) Option {
+	return func(wc *WordCounter) {
+		wc.limiter = nil
+		if requestsPerSecond > 0 {
+			wc.limiter = rate.NewLimiter(rate.Limit(requestsPerSecond), 1)
+		}
+	}
+}
+
+// Save the word counts and counted essays to a checkpoint file every N counted essays and when the run ends. If the
+// file already exists the counts are resumed from it and the essays in it are skipped
+func WithCheckpoint(path string, every int) Option {
+	return func(wc *WordCounter) {
+		wc.checkpointPath = path
+		wc.checkpointEvery = every
+	}
+}
+
+// Save the counts of every word, not just the top ones, to a file once the run ends so they can be sorted again with
+// CountFromSaved without fetching the essays. The file is a checkpoint, so it can also be resumed from with WithCheckpoint
+func WithSaveCounts(path string) Option {
+	return func(wc *WordCounter) {
+		wc.countsPath = path
+	}
+}
+
+// Cache the HTML of fetched essays in dir and count the cached HTML instead of fetching an essay again while it's
+// younger than ttl, e.g. to iterate on the word rules without hitting the network. An empty dir disables the cache
+func WithHTMLCache(dir string, ttl time.Duration) Option {
+	return func(wc *WordCounter) {
+		wc.htmlCacheDir = dir
+		wc.htmlCacheTTL = ttl
+	}
+}
+
+// Number of times a rate limited essay request is retried, defaults to 3
+func WithMaxRetries(maxRetries int) Option {
+	return func(wc *WordCounter) {
+		wc.maxRetries = maxRetries
+	}
+}
+
+// Number of times a request that failed with a transient network error (connection reset, DNS timeout) is retried
+// right away, separately from the rate limit retries. Defaults to 1
+func WithNetworkRetries(networkRetries int) Option {
+	return func(wc *WordCounter) {
+		wc.networkRetries = networkRetries
+	}
+}
+
+// Extra headers sent with every essay request
+func WithHeaders(headers http.Header) Option {
+	return func(wc *WordCounter) {
+		wc.headers = headers
+	}
+}
+
+// Essays with fewer than minEssayWords valid words (phrases with WithNgram) are left out of the counts and reported
+// as skipped in the summary, defaults to 0 which keeps every essay
+func WithMinEssayWords(minEssayWords int) Option {
+	return func(wc *WordCounter) {
+		wc.minEssayWords = minEssayWords
+	}
+}
+
+// Words counted fewer than minCount times are left out of the top words, the summary still includes them. Defaults to
+// 0 which keeps every word
+func WithMinCount(minCount int) Option {
+	return func(wc *WordCounter) {
+		wc.minCount = minCount
+	}
+}
+
+// Also return every word that makes up at least percent of all the valid words as Result.FrequentWords, most common
+// first, regardless of the top. Defaults to 0 which returns none
+func WithMinFreqPercent(percent float64) Option {
+	return func(wc *WordCounter) {
+		wc.minFreqPercent = percent
+	}
+}
+
+// Expected number of distinct words across all essays, the word map is allocated with room for this many words so it
+// doesn't rehash as it grows. Defaults to 0 which lets the map grow from empty
+func WithMapHint(mapHint int) Option {
+	return func(wc *WordCounter) {
+		wc.mapHint = mapHint
+	}
+}
+
+// Skip essays with a body (after decompression) larger than maxBodySize bytes instead of parsing them, so a huge or
+// broken page can't use up the memory. Defaults to 10MB, 0 for no limit
+func WithMaxBodySize(maxBodySize int64) Option {
+	return func(wc *WordCounter) {
+		wc.maxBodySize = maxBodySize
+	}
+}
+
+// Number of top words returned by CountFromURLs and CountFromReaders, defaults to 10
+func WithTop(top int) Option {
+	return func(wc *WordCounter) {
+		wc.top = top
+	}
+}
+
+// Called with every essay that failed to be fetched or parsed
+func WithFailureHandler(onFailure func(EssayFailure)) Option {
+	return func(wc *WordCounter) {
+		wc.onFailure = onFailure
+	}
+}
+
+// Record the essays fetched, failed and rate limited and the fetch latency in the metrics, for serve mode's /metrics
+func withMetrics(m *metrics) Option {
+	return func(wc *WordCounter) {
+		wc.metrics = m
+	}
+}
+
+// Add the total characters, average length and longest and shortest of the valid words to the summary, defaults to false
+func WithWordStats(wordStats bool) Option {
+	return func(wc *WordCounter) {
+		wc.wordStats = wordStats
+	}
+}
+
+/*
+How the workers merge the words of each essay into the corpus counts, defaults to MergeMutex. MergeSyncMap and
+MergeSharded merge without holding up the rest of the run, but they only keep the counts and document frequencies and
+hand them over once the essays are done. Checkpoints, snapshots, weighted counts and count thresholds need the counts
+as each essay is merged, with any of those NewWordCounter falls back to MergeMutex. See BenchmarkMerge for how they
+compare
+*/
+func WithMergeMode(mode MergeMode) Option {
+	return func(wc *WordCounter) {
+		if mode != "" {
+			wc.mergeMode = mode
+		}
+	}
+}
+
+// Also count the words of each category of essays apart, keyed by essay URL, and return the top words of each
+// category as Result.Categories. Essays without a category are only in the overall counts, and so are the essays
+// resumed from a checkpoint since the checkpoint has no categories. Defaults to nil which doesn't count categories
+func WithCategories(categories map[string]string) Option {
+	return func(wc *WordCounter) {
+		wc.categories = categories
+	}
+}
+
+// Log a line for every essay as it's done with its URL, status code, body size, fetch and parse time and valid words,
+// to find the slow or empty pages of a run. Defaults to false
+func WithTrace(trace bool) Option {
+	return func(wc *WordCounter) {
+		wc.trace = trace
+	}
+}
+
+// Write the progress of a run (essays processed out of the total) as a line of text to w every half a second instead
+// of logging it, to route it into the embedder's own output
+func WithProgressWriter(w io.Writer) Option {
+	return func(wc *WordCounter) {
+		wc.progressWriter = w
+	}
+}
+
+// Called once for every word whose total count reaches each of the thresholds while the essays are counted, e.g.
+// 100 and 1000, with the word's count and document frequency at that point. Called one at a time like the other
+// handlers
+func WithCountThresholds(thresholds []int, onThreshold func(WordCount)) Option {
+	return func(wc *WordCounter) {
+		wc.countThresholds = slices.Clone(thresholds)
+		slices.Sort(wc.countThresholds)
+		wc.onThreshold = onThreshold
+	}
+}
+
+// Called every interval while essays are counted with the top words and summary so far, e.g. for a live dashboard.
+// Snapshots are sorted on their own goroutine, one at a time, and the last one is handled before Count returns
+func WithSnapshotHandler(interval time.Duration, onSnapshot func(*Result)) Option {
+	return func(wc *WordCounter) {
+		wc.snapshotInterval = interval
+		wc.onSnapshot = onSnapshot
+	}
+}
+
+// Called with the word counts of every essay that was counted, keyed by the final essay URL after any redirects
+func WithEssayHandler(onEssay func(essayUrl string, essayWordMap map[string]int)) Option {
+	return func(wc *WordCounter) {
+		wc.onEssay = onEssay
+	}
+}
+
+// Create a WordCounter that counts the words in the word bank, the defaults match the assignment. With a nil word bank
+// (and no WithWordBankLoader, or one that returns nil) every word matching the regex is counted
+func NewWordCounter(wordBank *map[string]struct{}, opts ...Option) *WordCounter {
+	wc := &WordCounter{
+		client:         &http.Client{Timeout: 30 * time.Second},
+		bank:           &wordBankState{ready: make(chan struct{}), words: wordBank},
+		stopwords:      &map[string]struct{}{},
+		excluded:       &map[string]struct{}{},
+		workers:        DefaultWorkers,
+		maxRetries:     3,
+		networkRetries: 1,
+		maxBodySize:    DefaultMaxBodySize,
+		bodyFields:     []string{"articleBody"},
+		headers:        http.Header{},
+		top:            10,
+		rank:           RankCount,
+		normalize:      NormalizeNone,
+		order:          OrderDesc,
+		sortBy:         SortCount,
+		groupBy:        GroupNone,
+		mergeMode:      MergeMutex,
+		ngram:          1,
+		minDelay:       200 * time.Millisecond,
+		maxDelay:       time.Second,
+		minWordLength:  3,
+	}
+
+	for _, opt := range opts {
+		opt(wc)
+	}
+
+	// the loader runs right away so the word bank loads while the first essays are being fetched
+	if wc.wordBankLoader != nil {
+		go func(bank *wordBankState, load func() (*map[string]struct{}, error)) {
+			start := time.Now()
+			bank.words, bank.err = load()
+			bank.loadTime = time.Since(start)
+			close(bank.ready)
+		}(wc.bank, wc.wordBankLoader)
+	} else {
+		close(wc.bank.ready)
+	}
+
+	if wc.regExpression == nil {
+		wc.regExpression = wordRegexp(wc.minWordLength, wc.unicodeWords)
+	}
+
+	if wc.mergeMode != MergeMutex &&
+		(wc.checkpointPath != "" || wc.onSnapshot != nil || wc.weightsEssays() || wc.onThreshold != nil) {
+		slog.Warn("Checkpoints, snapshots, weighted counts and count thresholds need the mutex merge, using it instead",
+			"merge", wc.mergeMode)
+		wc.mergeMode = MergeMutex
+	}
+
+	if wc.timeout > 0 {
+		client := *wc.client
+		client.Timeout = wc.timeout
+		wc.client = &client
+	}
+
+	if wc.transport != nil {
+		client := *wc.client
+		client.Transport = wc.transport
+		wc.client = &client
+	}
+
+	if wc.noFollowRedirect {
+		client := *wc.client
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		wc.client = &client
+	}
+
+	return wc
+}
+
+// Compile regex for valid words, \b only understands ascii so the unicode pattern relies on the greedy match to take
+// whole runs of letters instead
+func wordRegexp(minWordLength int, unicodeWords bool) *regexp.Regexp {
+	if unicodeWords {
+		return regexp.MustCompile(fmt.Sprintf(`\p{L}{%d,}`, minWordLength))
+	}
+	return regexp.MustCompile(fmt.Sprintf(`\b[a-z]{%d,}\b`, minWordLength))
+}
+
+// Totals across all the essays that were counted, to put the top word counts in perspective
+type Summary struct {
+	TotalWords      int `json:"total_words"`
+	DistinctWords   int `json:"distinct_words"`
+	EssaysProcessed int `json:"essays_processed"`
+	EssaysFailed    int `json:"essays_failed"`
+	// essays that failed because we were still rate limited after all retries, included in EssaysFailed
+	EssaysRateLimited int `json:"essays_rate_limited"`
+	// essays that were fetched but left out of the counts for having fewer than -min-essay-words valid words
+	EssaysSkipped int `json:"essays_skipped"`
+	// number of workers fetching the essays, with WithAdaptiveWorkers the number it ended up at
+	Workers int `json:"workers,omitempty"`
+	// number of essay responses with each HTTP status code, every rate limited attempt of an essay that was retried
+	// included. Essays that failed before a response (e.g. connection errors) and saved essays have none
+	StatusCodes map[int]int `json:"status_codes,omitempty"`
+	Timings     Timings     `json:"timings"`
+	// peak goroutines and heap of the run, only set by Run with Config.Stats
+	Stats *RuntimeStats `json:"stats,omitempty"`
+	// lengths of the valid words, only set with WithWordStats
+	WordStats *WordStats `json:"word_stats,omitempty"`
+}
+
+// Length statistics of the valid words counted across all essays, lengths are in characters (runes). The longest and
+// shortest words are the alphabetically first of their length
+type WordStats struct {
+	// characters in all the valid words counted, a word counted twice adds its length twice
+	TotalChars    int     `json:"total_chars"`
+	AverageLength float64 `json:"average_length"`
+	LongestWord   string  `json:"longest_word"`
+	ShortestWord  string  `json:"shortest_word"`
+}
+
+// Peak runtime stats of a run, to size the number of workers. PeakHeapBytes is the live heap (HeapAlloc) at its largest
+// sample, so a short spike between samples can be missed
+type RuntimeStats struct {
+	PeakGoroutines int    `json:"peak_goroutines"`
+	PeakHeapBytes  uint64 `json:"peak_heap_bytes"`
+}
+
+// How long each phase of a run took in milliseconds, to tell whether the network or the CPU is the bottleneck.
+// WordBankMs is only set when the word bank is loaded with WithWordBankLoader, it overlaps with FetchMs
+type Timings struct {
+	WordBankMs int64 `json:"word_bank_ms"`
+	FetchMs    int64 `json:"fetch_ms"`
+	SortMs     int64 `json:"sort_ms"`
+}
+
+// Top words along with the summary of the essays they were counted from
+type Result struct {
+	Words   []WordCount `json:"words"`
+	Summary Summary     `json:"summary"`
+	// how many distinct words were counted how many times, across all words and not just the top ones
+	Histogram []HistogramBucket `json:"histogram"`
+	// top words of each category keyed by the category, only set with WithCategories. Percentages are of the
+	// category's own total
+	Categories map[string][]WordCount `json:"categories,omitempty"`
+	// every word that makes up at least the WithMinFreqPercent share of all valid words, only set with WithMinFreqPercent
+	FrequentWords []WordCount `json:"frequent_words,omitempty"`
+	// top words within each group of words keyed by the group (the first letter or the length), only set with WithGroupBy
+	Groups map[string][]WordCount `json:"groups,omitempty"`
+	// top words of each essay keyed by its URL and the essays that failed, only set by Run
+	Essays   map[string][]WordCount `json:"essays,omitempty"`
+	Failures []EssayFailure         `json:"failures,omitempty"`
+	// count of every word counted, not just the top ones, e.g. to look words up after the run
+	Counts map[string]int `json:"-"`
+}
+
+// Number of distinct words whose count is between Min and Max (inclusive), Max is 0 for the last open-ended bucket
+type HistogramBucket struct {
+	Label string `json:"label"`
+	Min   int    `json:"min"`
+	Max   int    `json:"max,omitempty"`
+	Words int    `json:"words"`
+}
+
+// Lower bounds of the histogram buckets, each bucket ends where the next one starts
+var histogramBounds = []int{1, 2, 5, 10, 50, 100, 500, 1000}
+
+// Bucket the words of the word map by their count, to show whether a few words dominate or the counts are spread out
+func wordHistogram(wordMap *map[string]int) []HistogramBucket {
+	buckets := make([]HistogramBucket, len(histogramBounds))
+	for i, min := range histogramBounds {
+		buckets[i].Min = min
+		if i+1 < len(histogramBounds) {
+			buckets[i].Max = histogramBounds[i+1] - 1
+		}
+		switch {
+		case buckets[i].Max == 0:
+			buckets[i].Label = fmt.Sprintf("%d+", min)
+		case buckets[i].Max == min:
+			buckets[i].Label = strconv.Itoa(min)
+		default:
+			buckets[i].Label = fmt.Sprintf("%d-%d", min, buckets[i].Max)
+		}
+	}
+
+	for _, count := range *wordMap {
+		// the last bucket whose lower bound the count reaches
+		i := sort.SearchInts(histogramBounds, count+1) - 1
+		if i >= 0 {
+			buckets[i].Words++
+		}
+	}
+
+	return buckets
+}
+
+/*
+Fetch the essays and return their top words. If the context is cancelled no new essays are fetched and the top words
+of the essays counted so far are returned along with the context's error.
+*/
+func (wc *WordCounter) CountFromURLs(ctx context.Context, urls []string) ([]WordCount, error) {
+	result, err := wc.Count(ctx, urls)
+	if result == nil {
+		return nil, err
+	}
+
+	return result.Words, err
+}
+
+// Same as CountFromURLs but also returns the summary of the essays. If the word bank fails to load there is nothing
+// to count the essays against, so the result is nil and the word bank's error is returned
+func (wc *WordCounter) Count(ctx context.Context, urls []string) (*Result, error) {
+	// the essays stop being fetched as soon as the word bank fails, rather than once they are all fetched
+	countCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-wc.bank.ready:
+			if wc.bank.err != nil {
+				cancel()
+			}
+		case <-countCtx.Done():
+		}
+	}()
+
+	fetchStart := time.Now()
+	counts, summary := wc.countEssays(countCtx, &urls)
+	summary.Timings.FetchMs = time.Since(fetchStart).Milliseconds()
+
+	// waits for the word bank in case there were no essays to count
+	if err := wc.waitForWordBank(); err != nil {
+		return nil, err
+	}
+	result := wc.result(counts, summary)
+	result.Summary.Timings.WordBankMs = wc.bank.loadTime.Milliseconds()
+
+	return result, ctx.Err()
+}
+
+// Number of essay responses with each status code, added to by the workers of a run
+type statusCounts struct {
+	mtx    sync.Mutex
+	counts map[int]int
+	// called with every status code once it's counted, e.g. to lower the adaptive workers on a 429
+	onStatus func(statusCode int)
+}
+
+func (s *statusCounts) add(statusCode int) {
+	s.mtx.Lock()
+	s.counts[statusCode]++
+	s.mtx.Unlock()
+	if s.onStatus != nil {
+		s.onStatus(statusCode)
+	}
+}
+
+// Copy of the counts so far, nil if there were no responses
+func (s *statusCounts) snapshot() map[int]int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.counts) == 0 {
+		return nil
+	}
+	return maps.Clone(s.counts)
+}
+
+// Word counts merged from all the essays that were counted
+type corpusCounts struct {
+	wordMap map[string]int
+	// number of essays each word appears in
+	docFreq map[string]int
+	// count of each word weighted per essay, by the essay's recency and/or by 1000 over its number of words with
+	// NormalizePer1000. nil unless essays are weighted, see essayWeight
+	weighted map[string]float64
+	// number of essays merged into the counts, including any resumed from a checkpoint
+	essays int
+	// word counts of each category of essays, nil unless WithCategories is set
+	categoryMaps map[string]map[string]int
+}
+
+// Count of a word weighted by essay, or just its count if the essays aren't weighted
+func (c *corpusCounts) weightedCount(word string, count int) float64 {
+	if c.weighted == nil {
+		return float64(count)
+	}
+	return c.weighted[word]
+}
+
+// Sort the word map into the top words, add their document frequency and fill in the word totals of the summary
+func (wc *WordCounter) result(counts *corpusCounts, summary Summary) *Result {
+	summary.DistinctWords = len(counts.wordMap)
+	for _, count := range counts.wordMap {
+		summary.TotalWords += count
+	}
+	if wc.wordStats {
+		summary.WordStats = wordStats(&counts.wordMap)
+	}
+
+	sortStart := time.Now()
+	var score func(word string, count int) float64
+	switch wc.normalize {
+	case NormalizeEssay:
+		score = func(word string, count int) float64 {
+			return counts.weightedCount(word, count) / float64(counts.docFreq[word])
+		}
+	case NormalizePer1000:
+		// the weighted counts are already per 1000 words of each essay, they only need averaging
+		score = func(word string, count int) float64 {
+			return counts.weightedCount(word, count) / float64(counts.essays)
+		}
+	default:
+		if counts.weighted != nil {
+			score = counts.weightedCount
+		}
+	}
+	if wc.rank == RankTfidf {
+		score = tfidfScore(counts, score)
+	}
+	topWords := sortWordMap(&counts.wordMap, wc.top, wc.minCount, score, wc.sortBy, wc.order == OrderAsc)
+	addPercentages(topWords, summary.TotalWords)
+	for i := range *topWords {
+		(*topWords)[i].DocFreq = counts.docFreq[(*topWords)[i].Word]
+	}
+	var groups map[string][]WordCount
+	if wc.groupBy != GroupNone {
+		groups = wc.groupTopWords(counts, score, summary.TotalWords)
+	}
+	var frequentWords []WordCount
+	if wc.minFreqPercent > 0 {
+		frequentWords = frequentWordCounts(counts, wc.minFreqPercent, summary.TotalWords)
+	}
+
+	var categories map[string][]WordCount
+	if counts.categoryMaps != nil {
+		categories = make(map[string][]WordCount, len(counts.categoryMaps))
+		for category, categoryMap := range counts.categoryMaps {
+			// like the words of a single essay, a category's words are ranked by count
+			categoryWords := sortWordMap(&categoryMap, wc.top, wc.minCount, nil, wc.sortBy, wc.order == OrderAsc)
+			addPercentages(categoryWords, totalWords(&categoryMap))
+			categories[category] = *categoryWords
+		}
+	}
+	summary.Timings.SortMs = time.Since(sortStart).Milliseconds()
+
+	return &Result{Words: *topWords, Summary: summary, Histogram: wordHistogram(&counts.wordMap), FrequentWords: frequentWords,
+		Groups: groups, Categories: categories, Counts: counts.wordMap}
+}
+
+// Every word that makes up at least percent of the total words, sorted by count descending. The share is turned into
+// the smallest count that reaches it so the words are picked with the same selection as the top words, just without
+// a top
+func frequentWordCounts(counts *corpusCounts, percent float64, totalWords int) []WordCount {
+	if totalWords == 0 {
+		return nil
+	}
+	// the epsilon keeps a share that lands exactly on a count (20% of 10) from being rounded up past it
+	minCount := max(1, int(math.Ceil(percent*float64(totalWords)/100-1e-9)))
+
+	frequentWords := sortWordMap(&counts.wordMap, len(counts.wordMap), minCount, nil, SortCount, false)
+	addPercentages(frequentWords, totalWords)
+	for i := range *frequentWords {
+		(*frequentWords)[i].DocFreq = counts.docFreq[(*frequentWords)[i].Word]
+	}
+
+	return *frequentWords
+}
+
+/*
+Partition the word map by the group of each word and pick the top words within each group the same way as the top
+words across all of them, so each group has up to top words ranked by the same score. Percentages are still of all the
+valid words, not of the group's
+*/
+func (wc *WordCounter) groupTopWords(counts *corpusCounts, score func(word string, count int) float64, totalWords int) map[string][]WordCount {
+	groupMaps := make(map[string]map[string]int)
+	for word, count := range counts.wordMap {
+		var group string
+		switch wc.groupBy {
+		case GroupFirstLetter:
+			first, _ := utf8.DecodeRuneInString(word)
+			group = string(first)
+		case GroupLength:
+			group = strconv.Itoa(utf8.RuneCountInString(word))
+		}
+		if groupMaps[group] == nil {
+			groupMaps[group] = make(map[string]int)
+		}
+		groupMaps[group][word] = count
+	}
+
+	groups := make(map[string][]WordCount, len(groupMaps))
+	for group, groupMap := range groupMaps {
+		groupWords := sortWordMap(&groupMap, wc.top, wc.minCount, score, wc.sortBy, wc.order == OrderAsc)
+		// a group whose words are all below the min count is left out rather than output empty
+		if len(*groupWords) == 0 {
+			continue
+		}
+		addPercentages(groupWords, totalWords)
+		for i := range *groupWords {
+			(*groupWords)[i].DocFreq = counts.docFreq[(*groupWords)[i].Word]
+		}
+		groups[group] = *groupWords
+	}
+
+	return groups
+}
+
+/*
+Score words by TF-IDF, the total count of the word multiplied by its inverse document frequency, so words used a lot
+in a few essays rank above words used everywhere. The IDF is smoothed (ln((1+N)/(1+df)) + 1) so a word in every
+essay still scores above 0 and ties are broken by count. If tf is set it's used instead of the count, e.g. a
+normalized count
+*/
+func tfidfScore(counts *corpusCounts, tf func(word string, count int) float64) func(word string, count int) float64 {
+	if tf == nil {
+		tf = counts.weightedCount
+	}
+	essays := float64(counts.essays)
+	return func(word string, count int) float64 {
+		idf := math.Log((1+essays)/(1+float64(counts.docFreq[word]))) + 1
+		return tf(word, count) * idf
+	}
+}
+
+/*
+Work out the length statistics of the valid words from the merged counts, rather than tracking them as each essay is
+merged, so the workers don't have to compare and update the longest and shortest word under the mutex. With
+WithNgram the words are phrases and their lengths include the spaces
+*/
+func wordStats(wordMap *map[string]int) *WordStats {
+	stats := &WordStats{}
+	totalWords := 0
+	longest, shortest := 0, 0
+	for word, count := range *wordMap {
+		length := utf8.RuneCountInString(word)
+		stats.TotalChars += length * count
+		totalWords += count
+		if stats.LongestWord == "" || length > longest || (length == longest && word < stats.LongestWord) {
+			stats.LongestWord, longest = word, length
+		}
+		if stats.ShortestWord == "" || length < shortest || (length == shortest && word < stats.ShortestWord) {
+			stats.ShortestWord, shortest = word, length
+		}
+	}
+	if totalWords > 0 {
+		stats.AverageLength = float64(stats.TotalChars) / float64(totalWords)
+	}
+	return stats
+}
+
+// Set the percentage of all valid words each word makes up
+func addPercentages(words *[]WordCount, totalWords int) {
+	if totalWords == 0 {
+		return
+	}
+	for i := range *words {
+		(*words)[i].Percent = float64((*words)[i].Count) / float64(totalWords) * 100
+	}
+}
+
+/*
+Count the words of essay HTML read from the readers and return their top words. Readers that fail to parse are skipped,
+their errors are joined and returned along with the top words of the rest.
+*/
+func (wc *WordCounter) CountFromReaders(readers ...io.Reader) ([]WordCount, error) {
+	counts := &corpusCounts{wordMap: make(map[string]int, wc.mapHint), docFreq: make(map[string]int, wc.mapHint)}
+	if wc.weightsEssays() {
+		counts.weighted = make(map[string]float64, wc.mapHint)
+	}
+
+	var errs []error
+	skipped := 0
+	// readers with the same body as one already counted are left out, like essays fetched from URLs
+	countedBodies := make(map[[sha256.Size]byte]struct{})
+	for i, r := range readers {
+		source := fmt.Sprintf("reader %d", i)
+		essay, err := wc.countReader(r, source)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source, err))
+			continue
+		}
+		if wc.minEssayWords > 0 && totalWords(essay.wordMap) < wc.minEssayWords {
+			skipped++
+			continue
+		}
+		if _, ok := countedBodies[essay.bodyHash]; ok {
+			slog.Debug("Skipping reader with the same body as one already counted", "source", source)
+			continue
+		}
+		countedBodies[essay.bodyHash] = struct{}{}
+		processEssay(&counts.wordMap, &counts.docFreq, &counts.weighted, essay.wordMap, wc.essayWeight(essay))
+		counts.essays++
+	}
+
+	summary := Summary{EssaysProcessed: len(readers), EssaysFailed: len(errs), EssaysSkipped: skipped}
+
+	return wc.result(counts, summary).Words, errors.Join(errs...)
+}
+
+/*
+Sort the counts saved by WithSaveCounts (or a checkpoint) into the top words without fetching any essays, so the
+options that only sort (top, min count, rank, normalize, order and sort) can be tried again on an expensive run. The
+words themselves were filtered when they were counted, the word bank, stopwords and the like have no effect here.
+Recency weights were also worked out when the counts were saved, with counts saved without them the words aren't
+weighted
+*/
+func (wc *WordCounter) CountFromSaved(path string) (*Result, error) {
+	cp, err := loadSavedCounts(path)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := &corpusCounts{wordMap: cp.WordMap, docFreq: cp.DocFreq, essays: len(cp.Completed)}
+	if wc.weightsEssays() {
+		if cp.Weighted == nil {
+			slog.Warn("Saved counts have no weighted counts, the words are not weighted", "path", path)
+		}
+		counts.weighted = cp.Weighted
+	}
+	slog.Info("Loaded counts", "path", path, "words", len(counts.wordMap), "essays", counts.essays)
+
+	return wc.result(counts, Summary{EssaysProcessed: counts.essays}), nil
+}
+
+/*
+Fetch and count the words of the essays with a fixed pool of workers. When the context is cancelled no new essays are
+picked up and the counts collected so far are returned, along with how many essays were processed and failed.
+*/
+func (wc *WordCounter) countEssays(ctx context.Context, essays *[]string) (*corpusCounts, Summary) {
+	// word map to store the count of each word across all essays, sized up front so it isn't rehashed as it grows
+	wordMap := make(map[string]int, wc.mapHint)
+	// number of essays each word appears in
+	docFreq := make(map[string]int, wc.mapHint)
+	// count of each word weighted by essay, only kept when essays are weighted
+	var weighted map[string]float64
+	if wc.weightsEssays() {
+		weighted = make(map[string]float64, wc.mapHint)
+	}
+	// number of essays merged into wordMap
+	counted := 0
+	// with MergeSyncMap and MergeSharded the words are merged outside of mtx, and only moved into wordMap at the end
+	var merger countMerger
+	if wc.mergeMode != MergeMutex {
+		merger = newCountMerger(wc.mergeMode)
+	}
+	// word counts of each category, merged into under the same mutex as wordMap
+	var categoryMaps map[string]map[string]int
+	if wc.categories != nil {
+		categoryMaps = make(map[string]map[string]int)
+	}
+
+	// essays counted so far, only tracked when checkpointing or saving the counts
+	var completed []string
+	if wc.checkpointPath != "" {
+		cp, err := loadCheckpoint(wc.checkpointPath)
+		if err != nil {
+			slog.Warn("Failed to load checkpoint, starting from scratch", "path", wc.checkpointPath, "error", err)
+			cp = &checkpoint{WordMap: make(map[string]int), DocFreq: make(map[string]int)}
+		}
+		wordMap, docFreq, completed = cp.WordMap, cp.DocFreq, cp.Completed
+		counted = len(completed)
+		// a checkpoint written without weighting has no weighted counts, so the essays in it only count from here on
+		if weighted != nil && cp.Weighted != nil {
+			weighted = cp.Weighted
+		}
+
+		remaining := skipCompleted(*essays, completed)
+		if skipped := len(*essays) - len(remaining); skipped > 0 {
+			slog.Info("Resuming from checkpoint", "path", wc.checkpointPath, "skipped", skipped)
+		}
+		essays = &remaining
+	}
+	sinceCheckpoint := 0
+
+	// final URLs of the essays counted in this run, after any redirects
+	countedUrls := make(map[string]struct{})
+	// body hashes of the essays counted in this run, syndicated essays can have the same body under different URLs.
+	// Like countedUrls it isn't checkpointed, so a resumed run only skips copies of essays counted since the resume
+	countedBodies := make(map[[sha256.Size]byte]struct{})
+
+	// Save the counts so far, must be called with mtx held
+	saveCheckpoint := func() {
+		if err := writeCheckpoint(wc.checkpointPath, &checkpoint{WordMap: wordMap, DocFreq: docFreq, Weighted: weighted, Completed: completed}); err != nil {
+			slog.Warn("Failed to write checkpoint", "path", wc.checkpointPath, "error", err)
+		}
+		sinceCheckpoint = 0
+	}
+
+	//mutex is needed so we can write to our hashmap concurrently without issues. Each worker counts an essay into its
+	// own local map without locking, so the mutex is only held to merge that map in once per essay
+	mtx := sync.Mutex{}
+
+	// the handlers get their own mutex so they are called one at a time without holding up the merges
+	reportMtx := sync.Mutex{}
+
+	// Essay URLs are fed to a fixed pool of workers through this channel, so memory usage stays predictable
+	// regardless of how many essays are in the file
+	essayUrls := make(chan string)
+
+	// with adaptive workers there is a goroutine for the most workers there can be, and only as many as the limit fetch
+	workers := wc.workers
+	var adaptive *adaptiveWorkers
+	if wc.maxAdaptiveWorkers > 0 {
+		adaptive = newAdaptiveWorkers(wc.maxAdaptiveWorkers)
+		workers = wc.maxAdaptiveWorkers
+	}
+	currentWorkers := func() int {
+		if adaptive != nil {
+			return adaptive.workers()
+		}
+		return workers
+	}
+
+	// Wait group tracks the workers, they exit once the essayUrls channel is closed and drained
+	var wg sync.WaitGroup
+	wg.Add(workers)
+
+	// Counters are incremented by the workers as each essay completes and read by the progress reporter
+	start := time.Now()
+	var processed, failed, rateLimited, thin, duplicateBodies atomic.Int64
+	progressDone := make(chan struct{})
+	go reportProgress(progressDone, &processed, len(*essays), wc.progressWriter)
+
+	// status codes of the essay responses, counted by the workers as each response comes in. Rate limited responses
+	// also lower the adaptive workers
+	statuses := &statusCounts{counts: make(map[int]int)}
+	if adaptive != nil {
+		statuses.onStatus = adaptive.observeStatus
+	}
+	summary := func() Summary {
+		return Summary{
+			EssaysProcessed:   int(processed.Load()),
+			EssaysFailed:      int(failed.Load()),
+			EssaysRateLimited: int(rateLimited.Load()),
+			EssaysSkipped:     int(thin.Load()),
+			Workers:           currentWorkers(),
+			StatusCodes:       statuses.snapshot(),
+		}
+	}
+
+	// Snapshots of the counts so far are taken under the mutex and sorted outside of it, so the workers are only held
+	// up for the copy. snapshotsDone is closed once the last snapshot is handled so it never comes after the result
+	snapshotsDone := make(chan struct{})
+	if wc.onSnapshot != nil {
+		go func() {
+			defer close(snapshotsDone)
+			ticker := time.NewTicker(wc.snapshotInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-progressDone:
+					return
+				case <-ticker.C:
+					mtx.Lock()
+					counts := &corpusCounts{
+						wordMap:  maps.Clone(wordMap),
+						docFreq:  maps.Clone(docFreq),
+						weighted: maps.Clone(weighted),
+						essays:   counted,
+					}
+					mtx.Unlock()
+					wc.onSnapshot(wc.result(counts, summary()))
+				}
+			}
+		}()
+	} else {
+		close(snapshotsDone)
+	}
+
+	// Each worker fetches an essay and extracts valid words from it. Then check if the valid words is within the word bank
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for essayUrl := range essayUrls {
+				if adaptive != nil {
+					adaptive.acquire()
+				}
+				essay, finalUrl, err := wc.fetchWordsFromEssay(ctx, essayUrl, statuses)
+				if adaptive != nil {
+					adaptive.release(err == nil)
+				}
+				processed.Add(1)
+				// words that reached a count threshold with this essay, reported once the mutex is released
+				var crossed []WordCount
+				if err != nil {
+					failed.Add(1)
+					if errors.Is(err, ErrRateLimited) {
+						rateLimited.Add(1)
+					}
+					if wc.onFailure != nil {
+						reportMtx.Lock()
+						wc.onFailure(EssayFailure{URL: essayUrl, Reason: failureReason(err), Error: err.Error()})
+						reportMtx.Unlock()
+					}
+					// no need to log every essay that was aborted because the run was cancelled
+					if ctx.Err() != nil {
+						continue
+					}
+					// a single failed essay should not stop the whole run, log and skip it
+					slog.Warn("Skipping essay", "url", essayUrl, "error", err)
+					continue
+				}
+
+				// thin pages (mostly not an article, or a degraded response) are left out of the counts, they are
+				// not checkpointed either so they are fetched again on resume
+				if wc.minEssayWords > 0 && totalWords(essay.wordMap) < wc.minEssayWords {
+					thin.Add(1)
+					slog.Debug("Skipping essay with too few valid words", "url", essayUrl, "words", totalWords(essay.wordMap))
+					continue
+				}
+
+				// without a word bank every word was counted, the run is being stopped and the essay is left out
+				if wc.wordBankFailed() {
+					continue
+				}
+
+				mtx.Lock()
+				// essays are deduped before they are fetched, but two URLs can still redirect to the same essay
+				_, duplicate := countedUrls[finalUrl]
+				_, duplicateBody := countedBodies[essay.bodyHash]
+				if !duplicate && !duplicateBody {
+					countedUrls[finalUrl] = struct{}{}
+					countedBodies[essay.bodyHash] = struct{}{}
+					if merger == nil {
+						processEssay(&wordMap, &docFreq, &weighted, essay.wordMap, wc.essayWeight(essay))
+					}
+					counted++
+					// the category is looked up by the URL in the essay list, not where it redirected to
+					if category := wc.categories[essayUrl]; categoryMaps != nil && category != "" {
+						if categoryMaps[category] == nil {
+							categoryMaps[category] = make(map[string]int)
+						}
+						for word, count := range *essay.wordMap {
+							categoryMaps[category][word] += count
+						}
+					}
+					if wc.onThreshold != nil {
+						crossed = crossedThresholds(&wordMap, &docFreq, essay.wordMap, wc.countThresholds)
+					}
+				}
+				if wc.checkpointPath != "" || wc.countsPath != "" {
+					completed = append(completed, essayUrl)
+				}
+				if wc.checkpointPath != "" {
+					sinceCheckpoint++
+					if sinceCheckpoint >= wc.checkpointEvery {
+						saveCheckpoint()
+					}
+				}
+				mtx.Unlock()
+
+				if merger != nil && !duplicate && !duplicateBody {
+					merger.merge(*essay.wordMap)
+				}
+
+				if duplicate {
+					slog.Info("Skipping essay that redirects to an essay already counted", "url", essayUrl, "final_url", finalUrl)
+					continue
+				}
+				if duplicateBody {
+					duplicateBodies.Add(1)
+					slog.Debug("Skipping essay with the same body as an essay already counted", "url", essayUrl)
+					continue
+				}
+
+				if wc.onEssay != nil {
+					reportMtx.Lock()
+					wc.onEssay(finalUrl, *essay.wordMap)
+					reportMtx.Unlock()
+				}
+				if len(crossed) > 0 {
+					reportMtx.Lock()
+					for _, wordCount := range crossed {
+						wc.onThreshold(wordCount)
+					}
+					reportMtx.Unlock()
+				}
+			}
+		}()
+	}
+
+	// Stop handing out URLs once the context is cancelled, the workers will drain and exit
+sendLoop:
+	for _, essayUrl := range *essays {
+		select {
+		case essayUrls <- essayUrl:
+		case <-ctx.Done():
+			break sendLoop
+		}
+	}
+	close(essayUrls)
+
+	wg.Wait()
+	close(progressDone)
+	<-snapshotsDone
+
+	if merger != nil {
+		wordMap, docFreq = merger.counts()
+	}
+
+	// the final checkpoint is always written, so a Ctrl-C loses nothing that was already counted. A run stopped by a
+	// word bank that failed to load has nothing worth saving
+	if wc.checkpointPath != "" && !wc.wordBankFailed() {
+		saveCheckpoint()
+	}
+	if wc.countsPath != "" && !wc.wordBankFailed() {
+		if err := writeCheckpoint(wc.countsPath, &checkpoint{WordMap: wordMap, DocFreq: docFreq, Weighted: weighted, Completed: completed}); err != nil {
+			slog.Error("Failed to save counts", "path", wc.countsPath, "error", err)
+		} else {
+			slog.Info("Saved counts", "path", wc.countsPath, "words", len(wordMap), "essays", counted)
+		}
+	}
+
+	slog.Info("Processed essays", "processed", processed.Load(), "succeeded", processed.Load()-failed.Load(),
+		"failed", failed.Load(), "duration", time.Since(start).Round(time.Millisecond))
+	if thin.Load() > 0 {
+		slog.Info("Skipped essays with too few valid words", "skipped", thin.Load(), "min_essay_words", wc.minEssayWords)
+	}
+	if duplicateBodies.Load() > 0 {
+		slog.Info("Skipped essays with a duplicate body", "skipped", duplicateBodies.Load())
+	}
+	if adaptive != nil {
+		slog.Info("Adapted the number of workers", "workers", adaptive.workers())
+	}
+	if codes := statuses.snapshot(); len(codes) > 0 {
+		slog.Info("Response status codes", "status_codes", codes)
+	}
+
+	return &corpusCounts{wordMap: wordMap, docFreq: docFreq, weighted: weighted, essays: counted, categoryMaps: categoryMaps}, summary()
+}
+
+// Remove the essays that are already in the checkpoint
+func skipCompleted(essays []string, completed []string) []string {
+	done := make(map[string]struct{}, len(completed))
+	for _, essayUrl := range completed {
+		done[essayUrl] = struct{}{}
+	}
+
+	remaining := make([]string, 0, len(essays))
+	for _, essayUrl := range essays {
+		if _, ok := done[essayUrl]; !ok {
+			remaining = append(remaining, essayUrl)
+		}
+	}
+
+	return remaining
+}
+
+// Random delay before an essay request. The global rand source is randomly seeded (Go 1.20+) so every run gets
+// different jitter
+func (wc *WordCounter) requestDelay() time.Duration {
+	if wc.maxDelay <= wc.minDelay {
+		return wc.minDelay
+	}
+	return wc.minDelay + time.Duration(rand.Int63n(int64(wc.maxDelay-wc.minDelay)))
+}
+
+// Valid words counted in an essay and when it was published
+type essayCounts struct {
+	wordMap *map[string]int
+	// zero if the essay has no ld+json datePublished that could be parsed
+	published time.Time
+	// hash of the normalized text the words were counted from, to spot the same body under several URLs
+	bodyHash [sha256.Size]byte
+	// size of the HTML read (after decompression) and how long reading and parsing it took, for WithTrace
+	bodyBytes int64
+	parseTime time.Duration
+}
+
+// Count the words of essay HTML from a reader, recovering from a panic like fetchWordsFromEssay does
+func (wc *WordCounter) countReader(r io.Reader, source string) (essay *essayCounts, err error) {
+	defer recoverEssay(source, &err)
+	return wc.countWordsInHtml(r, source)
+}
+
+// Recover from a panic while counting an essay and return it as an ErrPanic through err, so an unexpected bug with
+// one page (e.g. a nil dereference on odd HTML) fails that essay instead of taking down the run and its counts.
+// Must be deferred directly
+func recoverEssay(source string, err *error) {
+	if r := recover(); r != nil {
+		slog.Error("Recovered from panic while counting essay", "url", source, "panic", r, "stack", string(debug.Stack()))
+		*err = fmt.Errorf("%w: %v", ErrPanic, r)
+	}
+}
+
+// Fetch all valid words from the articleBody in essay HTML, a panic while doing so is returned as an ErrPanic. The
+// status code of every response is counted in statuses
+func (wc *WordCounter) fetchWordsFromEssay(ctx context.Context, essayUrl string, statuses *statusCounts) (essay *essayCounts, finalUrl string, err error) {
+	// deferred before recoverEssay so it runs after it, and a recovered panic is recorded as a failure
+	start := time.Now()
+	if wc.metrics != nil {
+		defer func() {
+			wc.metrics.observeFetch(time.Since(start), err)
+		}()
+	}
+	// status code of the essay's response and how long until it came in, none for essays read from disk
+	var statusCode int
+	var fetchTime time.Duration
+	if wc.trace {
+		defer func() {
+			wc.traceEssay(essayUrl, statusCode, fetchTime, essay, err)
+		}()
+	}
+	defer recoverEssay(essayUrl, &err)
+
+	// saved essays from -essay-dir are read from disk, no delay is needed since nothing is requested
+	if strings.HasPrefix(essayUrl, "file://") {
+		essay, err = wc.readEssayFile(essayUrl)
+		return essay, essayUrl, err
+	}
+
+	// cached essays are counted without a request, so they don't wait for the delay either
+	if wc.htmlCacheDir != "" {
+		var cached bool
+		essay, cached, err = wc.readCachedEssay(essayUrl)
+		if cached {
+			return essay, essayUrl, err
+		}
+	}
+
+	// sleep for random amount of time between minDelay and maxDelay (200-1000 msec by default) to avoid being rate limited
+	if delay := wc.requestDelay(); delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+	}
+	// the fetch latency doesn't include the delay, which only depends on the options
+	start = time.Now()
+
+	resp, err := wc.getEssayWithRetry(ctx, essayUrl, statuses)
+	fetchTime = time.Since(start)
+	if err != nil {
+		return nil, "", err
+	}
+	statusCode = resp.StatusCode
+
+	defer resp.Body.Close()
+
+	// the request of the response is the last one made, so its URL is where any redirects ended up
+	finalUrl = resp.Request.URL.String()
+	if finalUrl != essayUrl {
+		slog.Debug("Essay redirected", "url", essayUrl, "final_url", finalUrl)
+	}
+
+	// the transport only decompresses gzip itself when it set Accept-Encoding, so a custom Accept-Encoding header
+	// from WithHeaders gets the raw compressed body
+	var body io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gzipReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, finalUrl, fmt.Errorf("failed to decompress essay: %w", err)
+		}
+		defer gzipReader.Close()
+		body = gzipReader
+	}
+
+	// the body is cached under the URL that was asked for, since that's what the next run looks up
+	if wc.htmlCacheDir != "" {
+		essay, err = wc.countAndCacheEssay(body, essayUrl, finalUrl)
+		return essay, finalUrl, err
+	}
+
+	essay, err = wc.countWordsInHtml(body, finalUrl)
+	return essay, finalUrl, err
+}
+
+// Log the trace line of an essay once it's done. The body size, parse time and valid words are only known for essays
+// that were counted, a failed essay has its error and (for a bad status) the status code instead
+func (wc *WordCounter) traceEssay(essayUrl string, statusCode int, fetchTime time.Duration, essay *essayCounts, err error) {
+	var statusErr *StatusError
+	if statusCode == 0 && errors.As(err, &statusErr) {
+		statusCode = statusErr.StatusCode
+	}
+
+	args := []any{"url", essayUrl, "status", statusCode, "fetch_ms", fetchTime.Milliseconds()}
+	if essay != nil {
+		args = append(args, "bytes", essay.bodyBytes, "parse_ms", essay.parseTime.Milliseconds(), "words", totalWords(essay.wordMap))
+	}
+	if err != nil {
+		args = append(args, "error", err)
+	}
+	slog.Info("Essay trace", args...)
+}
+
+// Count the words of a saved essay given as a file:// URL
+func (wc *WordCounter) readEssayFile(essayUrl string) (*essayCounts, error) {
+	u, err := url.Parse(essayUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.FromSlash(u.Path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return wc.countWordsInHtml(f, essayUrl)
+}
+
+// Count the valid words in the articleBody of essay HTML, source is the essay URL (or other name) used in logs
+func (wc *WordCounter) countWordsInHtml(r io.Reader, source string) (*essayCounts, error) {
+	// valid words of the essay and their count, words are counted as they are matched so no slice of words is built
+	essayWordMap := make(map[string]int)
+
+	// the body is streamed into the parser, so reading it is part of the parse time
+	parseStart := time.Now()
+	counted := &countingReader{r: r}
+	r = counted
+	if wc.maxBodySize > 0 {
+		r = &maxBodyReader{r: r, remaining: wc.maxBodySize}
+	}
+	htmlFile, err := html.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// first error found while traversing the html nodes, only returned if no articleBody was found
+	var parseErr error
+	foundArticleBody := false
+	invalidUTF8 := false
+	// datePublished of the ld+json block the articleBody came from
+	var published time.Time
+	var bodyHash [sha256.Size]byte
+
+	// Traverse the html nodes and get the articleBody that is inside <script type="application/ld+json">.
+	// Returns true once an articleBody has been extracted so the traversal stops descending, if the page has
+	// several ld+json blocks with an articleBody the first one in document order wins and the rest are ignored
+	var f func(*html.Node) bool
+	f = func(n *html.Node) bool {
+		if n.Type == html.ElementNode && n.Data == "script" {
+			for _, a := range n.Attr {
+				if a.Key == "type" && isLdJsonType(a.Val) {
+					// an empty script tag has no text node to parse
+					if n.FirstChild == nil {
+						slog.Debug("Skipping empty ld+json script", "url", source)
+						return false
+					}
+
+					// encoding/json would silently replace invalid UTF-8 with U+FFFD, which also splits the word it
+					// was in, so it is checked here to log it or skip the essay instead
+					data := n.FirstChild.Data
+					if !utf8.ValidString(data) {
+						if wc.skipInvalidUTF8 {
+							invalidUTF8 = true
+							return true
+						}
+						slog.Warn("Replacing invalid UTF-8 in ld+json", "url", source)
+						data = strings.ToValidUTF8(data, "\uFFFD")
+					}
+
+					// Parse the json into a generic value as the block can be either a single object or an array of them
+					var ldJson interface{}
+					err := json.Unmarshal([]byte(data), &ldJson)
+					if err != nil {
+						if parseErr == nil {
+							parseErr = fmt.Errorf("%w: %w", ErrParse, err)
+						}
+						return false
+					}
+
+					// pages can have several ld+json blocks (e.g. breadcrumbs), only some of which have an articleBody
+					articleBody, ok := findArticleBody(ldJson, wc.bodyFields, source)
+					if !ok {
+						return false
+					}
+					foundArticleBody = true
+					published, _ = findDatePublished(ldJson)
+
+					bodyHash = hashBody(articleBody)
+					wc.countValidWords(articleBody, &essayWordMap)
+					return true
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if f(c) {
+				return true
+			}
+		}
+		return false
+	}
+	f(htmlFile)
+
+	if invalidUTF8 {
+		return nil, ErrInvalidUTF8
+	}
+
+	// pages without an articleBody are counted from the text of their paragraphs instead
+	if !foundArticleBody && wc.textFallback {
+		var text strings.Builder
+		paragraphText(htmlFile, &text, false)
+		if text.Len() > 0 {
+			slog.Debug("No articleBody, counting paragraph text instead", "url", source)
+			bodyHash = hashBody(text.String())
+			wc.countValidWords(text.String(), &essayWordMap)
+			foundArticleBody = true
+		}
+	}
+
+	if !foundArticleBody {
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		return nil, ErrNoArticleBody
+	}
+
+	// rate limiting is detected from the status code, so an empty map here means the article genuinely had no valid words
+	if len(essayWordMap) == 0 {
+		slog.Debug("No valid words found", "url", source)
+	}
+
+	if wc.recencyHalfLife > 0 && published.IsZero() {
+		slog.Debug("No datePublished, essay is not weighted by recency", "url", source)
+	}
+
+	return &essayCounts{wordMap: &essayWordMap, published: published, bodyHash: bodyHash, bodyBytes: counted.n,
+		parseTime: time.Since(parseStart)}, nil
+}
+
+// Reader that counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+/*
+Reader that fails with ErrBodyTooLarge once more than remaining bytes have been read. Unlike io.LimitReader, which would
+end the body early and have a truncated page parsed as if it was whole, the essay is skipped. html.Parse stops and
+returns the error as soon as it's hit, so at most the limit is buffered
+*/
+type maxBodyReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (m *maxBodyReader) Read(p []byte) (int, error) {
+	// one byte past the limit is read to tell a body of exactly the limit from a larger one
+	if int64(len(p)) > m.remaining+1 {
+		p = p[:m.remaining+1]
+	}
+	n, err := m.r.Read(p)
+	m.remaining -= int64(n)
+	if m.remaining < 0 {
+		return n, ErrBodyTooLarge
+	}
+	return n, err
+}
+
+// Hash of the text with case and whitespace normalized, so copies that only differ in those hash the same
+func hashBody(text string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(strings.ToLower(strings.Join(strings.Fields(text), " "))))
+}
+
+/*
+Match words in the text one at a time and increment the count of each valid word, rather than building a slice of
+every match with FindAllString. Each search resumes where the previous match ended, a match always ends on a letter
+followed by a non-letter so resuming there doesn't change where the regex finds word boundaries.
+
+With WithNgram(n) for n > 1 the last n valid words are kept in a window and counted as one space-joined phrase
+instead. A phrase only spans consecutive valid words in the same sentence, so the window is cleared on a word that
+isn't valid (including stopwords and words too short to match) and on sentence punctuation or a line break between
+two words
+*/
+func (wc *WordCounter) countValidWords(text string, essayWordMap *map[string]int) {
+	// lowercase the whole text first, otherwise the a-z regex skips capitalised words like the start of a sentence
+	text = strings.ToLower(text)
+
+	window := make([]string, 0, wc.ngram)
+	wordBank := wc.wordBank()
+
+	for len(text) > 0 {
+		loc := wc.regExpression.FindStringIndex(text)
+		if loc == nil {
+			return
+		}
+
+		word := text[loc[0]:loc[1]]
+		gap := text[:loc[0]]
+		text = text[loc[1]:]
+
+		// a letter in the gap is a word too short for the regex, which breaks up a phrase like any other invalid word
+		if wc.ngram > 1 && (strings.ContainsAny(gap, ".!?;\n") || strings.IndexFunc(gap, unicode.IsLetter) >= 0) {
+			window = window[:0]
+		}
+
+		if _, ok := (*wc.stopwords)[word]; ok {
+			window = window[:0]
+			continue
+		}
+		if _, ok := (*wc.excluded)[word]; ok {
+			window = window[:0]
+			continue
+		}
+		if wordBank != nil {
+			if _, ok := (*wordBank)[word]; !ok {
+				window = window[:0]
+				continue
+			}
+		}
+
+		// stems are often not in the word bank, so the word is checked before it's stemmed
+		if wc.stem {
+			word = stemWord(word)
+		}
+
+		if wc.ngram <= 1 {
+			(*essayWordMap)[word]++
+			continue
+		}
+
+		if len(window) == wc.ngram {
+			window = append(window[:0], window[1:]...)
+		}
+		window = append(window, word)
+		if len(window) == wc.ngram {
+			(*essayWordMap)[strings.Join(window, " ")]++
+		}
+	}
+}
+
+/*
+Write the visible text of the <p> elements under n to text, one paragraph per line so n-grams don't span paragraphs.
+Text in script, style, nav and noscript elements is never visible article text so those are skipped entirely
+*/
+func paragraphText(n *html.Node, text *strings.Builder, inParagraph bool) {
+	if n.Type == html.ElementNode {
+		switch n.Data {
+		case "script", "style", "nav", "noscript":
+			return
+		case "p":
+			inParagraph = true
+		}
+	}
+	if n.Type == html.TextNode && inParagraph {
+		text.WriteString(n.Data)
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		paragraphText(c, text, inParagraph)
+	}
+
+	if n.Type == html.ElementNode && n.Data == "p" {
+		text.WriteString("\n")
+	}
+}
+
+// Whether a script type is ld+json, compared as a media type so case, whitespace and parameters (e.g.
+// "application/LD+JSON; charset=utf-8") don't matter
+func isLdJsonType(scriptType string) bool {
+	mediaType, _, err := mime.ParseMediaType(scriptType)
+	return err == nil && mediaType == "application/ld+json"
+}
+
+/*
+Get the essay body from a parsed ld+json block, which is either a single object or an array of objects. The fields are
+tried in order and the first one any object has as a string wins, so a later field is only used when no object in the
+block has an earlier one. A body split into an array of strings is joined, a field of any other type (e.g. a number or
+an object) is logged and skipped as if it wasn't there. source is the essay URL used in the logs
+*/
+func findArticleBody(ldJson interface{}, fields []string, source string) (string, bool) {
+	var objects []interface{}
+	switch v := ldJson.(type) {
+	case map[string]interface{}:
+		objects = []interface{}{v}
+	case []interface{}:
+		objects = v
+	}
+
+	for _, field := range fields {
+		for _, element := range objects {
+			m, ok := element.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			value, ok := m[field]
+			if !ok {
+				continue
+			}
+			if body, ok := bodyString(value); ok {
+				return body, true
+			}
+			slog.Warn("Skipping ld+json body that is not a string", "url", source, "field", field, "type", fmt.Sprintf("%T", value))
+		}
+	}
+
+	return "", false
+}
+
+// The body as a string if it's a string or an array of only strings, which are joined with newlines
+func bodyString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, part := range v {
+			s, ok := part.(string)
+			if !ok {
+				return "", false
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, "\n"), true
+	}
+	return "", false
+}
+
+// Layouts datePublished is parsed with, full timestamps with or without a timezone and plain dates
+var datePublishedLayouts = []string{time.RFC3339, "2006-01-02T15:04:05Z0700", "2006-01-02T15:04:05", "2006-01-02"}
+
+// Get the first datePublished that can be parsed from a parsed ld+json block, an object or an array of objects
+func findDatePublished(ldJson interface{}) (time.Time, bool) {
+	var objects []interface{}
+	switch v := ldJson.(type) {
+	case map[string]interface{}:
+		objects = []interface{}{v}
+	case []interface{}:
+		objects = v
+	}
+
+	for _, element := range objects {
+		m, ok := element.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		date, ok := m["datePublished"].(string)
+		if !ok {
+			continue
+		}
+		for _, layout := range datePublishedLayouts {
+			if t, err := time.Parse(layout, date); err == nil {
+				return t, true
+			}
+		}
+	}
+
+	return time.Time{}, false
+}
+
+/*
+Send a request for the essay, retrying it right away up to networkRetries times when it fails with a transient network
+error like a connection reset or a DNS timeout. Unlike rate limits these are usually gone on the next try, so there is
+no backoff. The counter's headers are added to every request, and every try waits for the rate limiter if there is one
+*/
+func (wc *WordCounter) doRequest(ctx context.Context, essayUrl string) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		// the limiter is shared by all workers so this caps the total request rate, retries included
+		if wc.limiter != nil {
+			if err := wc.limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", essayUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range wc.headers {
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+
+		resp, err := wc.client.Do(req)
+		if err == nil || ctx.Err() != nil || !isTransientNetworkError(err) {
+			return resp, err
+		}
+		if retry == wc.networkRetries {
+			if retry > 0 {
+				err = fmt.Errorf("after %d retries: %w", retry, err)
+			}
+			return nil, err
+		}
+		slog.Debug("Network error, retrying", "url", essayUrl, "attempt", retry+1, "error", err)
+	}
+}
+
+// Whether a failed request is worth retrying right away: a connection that was reset or closed before the response,
+// a DNS lookup that failed temporarily, or a timeout. Other errors like a refused connection or an unknown host are
+// unlikely to go away on their own
+func isTransientNetworkError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+/*
+Fetch the essay, retrying with exponential backoff (1s, 2s, 4s...) while we are being rate limited (429 or 503).
+The Retry-After header is honoured when present. Any other non-200 status is returned as an error right away.
+The counter's headers are added to every request, and every attempt waits for the rate limiter if there is one.
+The status code of every attempt's response is counted in statuses.
+*/
+func (wc *WordCounter) getEssayWithRetry(ctx context.Context, essayUrl string, statuses *statusCounts) (*http.Response, error) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		resp, err := wc.doRequest(ctx, essayUrl)
+		if err != nil {
+			return nil, err
+		}
+		statuses.add(resp.StatusCode)
+
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		// a small error page is read to the end so the connection can be reused for the next request
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+
+		// only reached when redirects are not followed, otherwise the client already followed it
+		if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+			return nil, fmt.Errorf("%w to %q: %w", ErrRedirected, resp.Header.Get("Location"), &StatusError{StatusCode: resp.StatusCode})
+		}
+
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+			return nil, &StatusError{StatusCode: resp.StatusCode}
+		}
+		if wc.metrics != nil {
+			wc.metrics.rateLimitHits.Inc()
+		}
+
+		if attempt == wc.maxRetries {
+			return nil, fmt.Errorf("%w after %d retries: %w", ErrRateLimited, wc.maxRetries, &StatusError{StatusCode: resp.StatusCode})
+		}
+
+		wait := backoff
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			wait = retryAfter
+		}
+		backoff *= 2
+		slog.Debug("Rate limited, retrying", "url", essayUrl, "status", resp.StatusCode, "attempt", attempt+1, "wait", wait)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Parse the Retry-After header, which is either a number of seconds or an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date), true
+	}
+
+	return 0, false
+}
+
+// Categorise why an essay failed for the failures report
+func failureReason(err error) string {
+	var statusErr *StatusError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	case errors.Is(err, ErrRateLimited):
+		return "rate limited"
+	case errors.Is(err, ErrRedirected):
+		return "redirected"
+	case errors.As(err, &statusErr):
+		return "non-200 status"
+	case errors.Is(err, ErrNoArticleBody):
+		return "no articleBody"
+	case errors.Is(err, ErrParse):
+		return "parse error"
+	case errors.Is(err, ErrInvalidUTF8):
+		return "invalid utf-8"
+	case errors.Is(err, ErrBodyTooLarge):
+		return "body too large"
+	case errors.Is(err, ErrPanic):
+		return "panic"
+	case errors.Is(err, fs.ErrNotExist):
+		return "file not found"
+	default:
+		return "network error"
+	}
+}
+
+// Number of valid words in an essay
+func totalWords(essayWordMap *map[string]int) int {
+	total := 0
+	for _, count := range *essayWordMap {
+		total += count
+	}
+	return total
+}
+
+// Update the wordMap with the word counts of an essay. wordMap key are valid words and value is the count, docFreq
+// counts the essays each word appears in and weighted adds the counts multiplied by the essay's weight, unless it's nil
+func processEssay(wordMap *map[string]int, docFreq *map[string]int, weighted *map[string]float64, essayWordMap *map[string]int, weight float64) {
+	for word, count := range *essayWordMap {
+		(*wordMap)[word] += count
+		(*docFreq)[word]++
+		if *weighted != nil {
+			(*weighted)[word] += float64(count) * weight
+		}
+	}
+}
+
+// Whether the words of each essay are weighted, by recency or to normalize them per 1000 words
+func (wc *WordCounter) weightsEssays() bool {
+	return wc.recencyHalfLife > 0 || wc.normalize == NormalizePer1000
+}
+
+// Weight the counts of an essay are multiplied by, its recency weight and with NormalizePer1000 1000 over its number of
+// valid words, so the weighted counts are per 1000 words
+func (wc *WordCounter) essayWeight(essay *essayCounts) float64 {
+	weight := wc.recencyWeight(essay.published)
+	if wc.normalize == NormalizePer1000 {
+		if total := totalWords(essay.wordMap); total > 0 {
+			weight *= 1000 / float64(total)
+		}
+	}
+	return weight
+}
+
+// The words of an essay just merged into wordMap whose total count reached one of the thresholds with it, a word that
+// jumped past several thresholds at once is returned once for each
+func crossedThresholds(wordMap *map[string]int, docFreq *map[string]int, essayWordMap *map[string]int, thresholds []int) []WordCount {
+	var crossed []WordCount
+	for word, count := range *essayWordMap {
+		total := (*wordMap)[word]
+		for _, threshold := range thresholds {
+			if total-count < threshold && threshold <= total {
+				crossed = append(crossed, WordCount{Word: word, Count: total, DocFreq: (*docFreq)[word]})
+			}
+		}
+	}
+	return crossed
+}
+
+// Recency weight of an essay published at the given time, see WithRecencyWeight
+func (wc *WordCounter) recencyWeight(published time.Time) float64 {
+	if wc.recencyHalfLife <= 0 || published.IsZero() {
+		return 1
+	}
+	age := wc.recencyNow.Sub(published)
+	if age <= 0 {
+		return 1
+	}
+	return math.Pow(0.5, float64(age)/float64(wc.recencyHalfLife))
+}
+
+// Log how many essays have been processed out of the total, or write it to w when it is set, at most twice a second
+// and only when it has changed
+func reportProgress(done <-chan struct{}, processed *atomic.Int64, total int, w io.Writer) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	var last int64
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			current := processed.Load()
+			if current == last || total == 0 {
+				continue
+			}
+			last = current
+			percent := float64(current) / float64(total) * 100
+			if w != nil {
+				fmt.Fprintf(w, "Progress: %d/%d essays (%.1f%%)\n", current, total, percent)
+				continue
+			}
+			slog.Info("Progress", "processed", current, "total", total, "percent", fmt.Sprintf("%.1f", percent))
+		}
+	}
+}
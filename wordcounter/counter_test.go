@@ -0,0 +1,493 @@
+package wordcounter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The counter logs every skipped essay, which would bury the test output
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// Essay page with the body in an ld+json articleBody, like the engadget pages
+func ldJsonPage(body string) string {
+	return `<html><head><script type="application/ld+json">{"@type":"NewsArticle","articleBody":"` + body +
+		`"}</script></head><body></body></html>`
+}
+
+// Server with a canned response for each path, other paths are a 404
+func newEssayServer(t *testing.T, pages map[string]string, statuses map[string]int) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status, ok := statuses[r.URL.Path]; ok {
+			w.WriteHeader(status)
+			return
+		}
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(page))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Word counter for tests, without the random delay or rate limit retries so nothing waits
+func newTestCounter(wordBank *map[string]struct{}, opts ...Option) *WordCounter {
+	opts = append([]Option{WithDelay(0, 0), WithMaxRetries(0)}, opts...)
+	return NewWordCounter(wordBank, opts...)
+}
+
+func fetchEssay(t *testing.T, wc *WordCounter, essayUrl string) (*essayCounts, error) {
+	t.Helper()
+	essay, _, err := wc.fetchWordsFromEssay(context.Background(), essayUrl, &statusCounts{counts: make(map[int]int)})
+	return essay, err
+}
+
+func TestCountFromURLs(t *testing.T) {
+	server := newEssayServer(t, map[string]string{
+		"/first":  ldJsonPage("The cat sat on the mat with another cat"),
+		"/second": ldJsonPage("A cat and a dog"),
+	}, nil)
+	wordBank := &map[string]struct{}{"cat": {}, "mat": {}, "dog": {}, "the": {}, "sat": {}}
+
+	words, err := newTestCounter(wordBank, WithTop(3)).CountFromURLs(context.Background(),
+		[]string{server.URL + "/first", server.URL + "/second"})
+	if err != nil {
+		t.Fatalf("CountFromURLs() error = %v", err)
+	}
+
+	want := []WordCount{{Word: "cat", Count: 3, DocFreq: 2}, {Word: "the", Count: 2, DocFreq: 1}, {Word: "dog", Count: 1, DocFreq: 1}}
+	if len(words) != len(want) {
+		t.Fatalf("CountFromURLs() = %+v, want %+v", words, want)
+	}
+	for i := range want {
+		if words[i].Word != want[i].Word || words[i].Count != want[i].Count || words[i].DocFreq != want[i].DocFreq {
+			t.Errorf("word %d = %+v, want %+v", i, words[i], want[i])
+		}
+	}
+}
+
+func TestCountSummary(t *testing.T) {
+	server := newEssayServer(t, map[string]string{
+		"/essay":   ldJsonPage("words in an essay"),
+		"/no-body": `<html><body><p>no ld+json here</p></body></html>`,
+	}, map[string]int{"/limited": http.StatusTooManyRequests})
+
+	result, err := newTestCounter(nil).Count(context.Background(),
+		[]string{server.URL + "/essay", server.URL + "/no-body", server.URL + "/limited"})
+	if err != nil {
+		t.Fatalf("Count() error = %v", err)
+	}
+
+	summary := result.Summary
+	if summary.EssaysProcessed != 3 || summary.EssaysFailed != 2 || summary.EssaysRateLimited != 1 {
+		t.Errorf("summary = %+v, want 3 processed, 2 failed and 1 rate limited", summary)
+	}
+	// "in" and "an" are shorter than the min length of 3
+	if summary.TotalWords != 2 {
+		t.Errorf("total words = %d, want 2", summary.TotalWords)
+	}
+	if summary.StatusCodes[http.StatusTooManyRequests] != 1 || summary.StatusCodes[http.StatusOK] != 2 {
+		t.Errorf("status codes = %v, want one 429 and two 200s", summary.StatusCodes)
+	}
+}
+
+func TestFetchWordsFromEssayErrors(t *testing.T) {
+	server := newEssayServer(t, map[string]string{
+		"/no-body":    `<html><head><script type="application/ld+json">{"headline":"no body"}</script></head></html>`,
+		"/empty-body": ldJsonPage(""),
+	}, map[string]int{"/limited": http.StatusTooManyRequests, "/gone": http.StatusNotFound})
+
+	tests := []struct {
+		path    string
+		wantErr error
+	}{
+		{"/no-body", ErrNoArticleBody},
+		{"/limited", ErrRateLimited},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, err := fetchEssay(t, newTestCounter(nil), server.URL+tt.path)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("fetchWordsFromEssay() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("/gone", func(t *testing.T) {
+		_, err := fetchEssay(t, newTestCounter(nil), server.URL+"/gone")
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+			t.Errorf("fetchWordsFromEssay() error = %v, want a 404 StatusError", err)
+		}
+	})
+
+	// an empty articleBody is still an article, it just has no words to count
+	t.Run("/empty-body", func(t *testing.T) {
+		essay, err := fetchEssay(t, newTestCounter(nil), server.URL+"/empty-body")
+		if err != nil {
+			t.Fatalf("fetchWordsFromEssay() error = %v", err)
+		}
+		if len(*essay.wordMap) != 0 {
+			t.Errorf("words = %v, want none", *essay.wordMap)
+		}
+	})
+}
+
+// An empty ld+json script has nothing to unmarshal, the essay should fail without a body instead of panicking
+func TestCountReaderEmptyLdJson(t *testing.T) {
+	page := `<html><head><script type="application/ld+json"></script></head><body></body></html>`
+	_, err := newTestCounter(nil).countReader(strings.NewReader(page), "empty-ld-json")
+	if errors.Is(err, ErrPanic) {
+		t.Fatalf("countReader() panicked: %v", err)
+	}
+	if !errors.Is(err, ErrNoArticleBody) {
+		t.Errorf("countReader() error = %v, want %v", err, ErrNoArticleBody)
+	}
+}
+
+// Capitalised words like the start of a sentence are lowercased before matching, so "The" counts as "the"
+func TestCountValidWordsLowercases(t *testing.T) {
+	wc := newTestCounter(&map[string]struct{}{"the": {}, "cat": {}})
+	essayWordMap := make(map[string]int)
+	wc.countValidWords("The cat chased THE other Cat", &essayWordMap)
+
+	want := map[string]int{"the": 2, "cat": 2}
+	if !reflect.DeepEqual(essayWordMap, want) {
+		t.Errorf("words = %v, want %v", essayWordMap, want)
+	}
+}
+
+// Article body with a byte that isn't valid UTF-8 in the middle of it
+func TestCountReaderInvalidUTF8(t *testing.T) {
+	page := ldJsonPage("the cat sat on the m\xffat")
+
+	essay, err := newTestCounter(nil).countReader(strings.NewReader(page), "invalid-utf8")
+	if err != nil {
+		t.Fatalf("countReader() error = %v", err)
+	}
+	// the invalid byte is replaced, which splits the word it was in
+	want := map[string]int{"the": 2, "cat": 1, "sat": 1}
+	if !reflect.DeepEqual(*essay.wordMap, want) {
+		t.Errorf("words = %v, want %v", *essay.wordMap, want)
+	}
+
+	_, err = newTestCounter(nil, WithSkipInvalidUTF8(true)).countReader(strings.NewReader(page), "invalid-utf8")
+	if !errors.Is(err, ErrInvalidUTF8) {
+		t.Errorf("countReader() with WithSkipInvalidUTF8 error = %v, want %v", err, ErrInvalidUTF8)
+	}
+}
+
+// The ld+json script type is matched as a media type, not as an exact string
+func TestCountReaderLdJsonType(t *testing.T) {
+	for _, scriptType := range []string{"application/LD+JSON", " Application/Ld+Json ", "application/ld+json; charset=utf-8"} {
+		t.Run(scriptType, func(t *testing.T) {
+			page := `<html><head><script type="` + scriptType + `">{"articleBody":"the cat"}</script></head></html>`
+			essay, err := newTestCounter(nil).countReader(strings.NewReader(page), "ld-json-type")
+			if err != nil {
+				t.Fatalf("countReader() error = %v", err)
+			}
+			want := map[string]int{"the": 1, "cat": 1}
+			if !reflect.DeepEqual(*essay.wordMap, want) {
+				t.Errorf("words = %v, want %v", *essay.wordMap, want)
+			}
+		})
+	}
+
+	page := `<html><head><script type="application/json">{"articleBody":"the cat"}</script></head></html>`
+	if _, err := newTestCounter(nil).countReader(strings.NewReader(page), "ld-json-type"); !errors.Is(err, ErrNoArticleBody) {
+		t.Errorf("countReader() of a plain JSON script error = %v, want %v", err, ErrNoArticleBody)
+	}
+}
+
+// A body over the max size fails the essay instead of being cut short and parsed, one of exactly the max is counted
+func TestCountReaderMaxBodySize(t *testing.T) {
+	page := ldJsonPage("the cat sat on the mat")
+	size := int64(len(page))
+
+	essay, err := newTestCounter(nil, WithMaxBodySize(size)).countReader(strings.NewReader(page), "max-body-size")
+	if err != nil {
+		t.Fatalf("countReader() of a body at the limit error = %v", err)
+	}
+	if (*essay.wordMap)["cat"] != 1 {
+		t.Errorf("words = %v, want cat counted", *essay.wordMap)
+	}
+
+	_, err = newTestCounter(nil, WithMaxBodySize(size-1)).countReader(strings.NewReader(page), "max-body-size")
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("countReader() of a body over the limit error = %v, want %v", err, ErrBodyTooLarge)
+	}
+
+	// a large page goes through an essay server too, where it's read from the response as it streams in
+	server := newEssayServer(t, map[string]string{"/large": ldJsonPage(strings.Repeat("cat ", 1<<16))}, nil)
+	_, err = fetchEssay(t, newTestCounter(nil, WithMaxBodySize(1<<10)), server.URL+"/large")
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("fetchWordsFromEssay() error = %v, want %v", err, ErrBodyTooLarge)
+	}
+}
+
+// Reader that panics like a bug partway through an essay would
+type panicReader struct{}
+
+func (panicReader) Read(p []byte) (int, error) {
+	panic("read from a broken essay")
+}
+
+// A panic while counting one essay fails it with ErrPanic, and the run carries on with the others
+func TestCountReaderPanic(t *testing.T) {
+	_, err := newTestCounter(nil).countReader(panicReader{}, "panic")
+	if !errors.Is(err, ErrPanic) {
+		t.Errorf("countReader() error = %v, want %v", err, ErrPanic)
+	}
+
+	words, err := newTestCounter(nil).CountFromReaders(panicReader{}, strings.NewReader(ldJsonPage("the cat")))
+	if !errors.Is(err, ErrPanic) {
+		t.Errorf("CountFromReaders() error = %v, want %v", err, ErrPanic)
+	}
+	if len(words) != 2 {
+		t.Errorf("words = %v, want the words of the reader that didn't panic", words)
+	}
+}
+
+// Only a string or an array of strings is an article body, anything else is skipped as if the field wasn't there
+func TestCountReaderBodyTypes(t *testing.T) {
+	page := func(ldJson string) string {
+		return `<html><head><script type="application/ld+json">` + ldJson + `</script></head></html>`
+	}
+
+	tests := []struct {
+		name    string
+		ldJson  string
+		want    map[string]int
+		wantErr error
+	}{
+		{"numeric articleBody", `{"articleBody":42}`, nil, ErrNoArticleBody},
+		{"numeric articleBody falls back to text", `{"articleBody":42,"text":"the cat"}`, map[string]int{"the": 1, "cat": 1}, nil},
+		{"array of strings", `{"articleBody":["the cat","sat down"]}`, map[string]int{"the": 1, "cat": 1, "sat": 1, "down": 1}, nil},
+		{"array with a number", `{"articleBody":["the cat",42]}`, nil, ErrNoArticleBody},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wc := newTestCounter(nil, WithBodyFields("articleBody", "text"))
+			essay, err := wc.countReader(strings.NewReader(page(tt.ldJson)), "body-types")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("countReader() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("countReader() error = %v", err)
+			}
+			if !reflect.DeepEqual(*essay.wordMap, tt.want) {
+				t.Errorf("words = %v, want %v", *essay.wordMap, tt.want)
+			}
+		})
+	}
+}
+
+// Round tripper that counts the requests made through it
+type countingTransport struct {
+	requests int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestOptions(t *testing.T) {
+	t.Run("WithWorkers", func(t *testing.T) {
+		if wc := newTestCounter(nil); wc.workers != DefaultWorkers {
+			t.Errorf("default workers = %d, want %d", wc.workers, DefaultWorkers)
+		}
+		if wc := newTestCounter(nil, WithWorkers(5)); wc.workers != 5 {
+			t.Errorf("workers = %d, want 5", wc.workers)
+		}
+	})
+
+	t.Run("WithTimeout", func(t *testing.T) {
+		if wc := newTestCounter(nil); wc.client.Timeout != 30*time.Second {
+			t.Errorf("default timeout = %v, want 30s", wc.client.Timeout)
+		}
+		client := &http.Client{Timeout: time.Minute}
+		wc := newTestCounter(nil, WithHTTPClient(client), WithTimeout(5*time.Second))
+		if wc.client.Timeout != 5*time.Second {
+			t.Errorf("timeout = %v, want 5s", wc.client.Timeout)
+		}
+		// the timeout goes on a copy, the caller's client keeps its own
+		if client.Timeout != time.Minute {
+			t.Errorf("given client timeout = %v, want it left at 1m", client.Timeout)
+		}
+	})
+
+	t.Run("WithMinWordLength", func(t *testing.T) {
+		essayWordMap := make(map[string]int)
+		newTestCounter(nil, WithMinWordLength(5)).countValidWords("a cat and a horse", &essayWordMap)
+		want := map[string]int{"horse": 1}
+		if !reflect.DeepEqual(essayWordMap, want) {
+			t.Errorf("words = %v, want %v", essayWordMap, want)
+		}
+	})
+
+	t.Run("WithStopwords", func(t *testing.T) {
+		essayWordMap := make(map[string]int)
+		wc := newTestCounter(nil, WithStopwords(&map[string]struct{}{"the": {}, "and": {}}))
+		wc.countValidWords("the cat and the dog", &essayWordMap)
+		want := map[string]int{"cat": 1, "dog": 1}
+		if !reflect.DeepEqual(essayWordMap, want) {
+			t.Errorf("words = %v, want %v", essayWordMap, want)
+		}
+	})
+
+	t.Run("WithHTTPClient", func(t *testing.T) {
+		server := newEssayServer(t, map[string]string{"/essay": ldJsonPage("a cat")}, nil)
+		transport := &countingTransport{}
+		wc := newTestCounter(nil, WithHTTPClient(&http.Client{Transport: transport}))
+		if _, err := fetchEssay(t, wc, server.URL+"/essay"); err != nil {
+			t.Fatalf("fetchWordsFromEssay() error = %v", err)
+		}
+		if transport.requests != 1 {
+			t.Errorf("requests through the given client = %d, want 1", transport.requests)
+		}
+	})
+}
+
+// Made up vocabulary of n distinct lowercase words, the same on every run
+func benchVocabulary(n int) []string {
+	rng := rand.New(rand.NewSource(1))
+	vocabulary := make([]string, n)
+	for i := range vocabulary {
+		word := make([]byte, 3+rng.Intn(8))
+		for j := range word {
+			word[j] = byte('a' + rng.Intn(26))
+		}
+		vocabulary[i] = string(word)
+	}
+	return vocabulary
+}
+
+// Essay text of n words drawn from the vocabulary, skewed towards its first words like a real text
+func benchEssay(vocabulary []string, n int, seed int64) string {
+	rng := rand.New(rand.NewSource(seed))
+	zipf := rand.NewZipf(rng, 1.1, 1, uint64(len(vocabulary)-1))
+	var text strings.Builder
+	for i := 0; i < n; i++ {
+		text.WriteString(vocabulary[zipf.Uint64()])
+		text.WriteByte(' ')
+	}
+	return text.String()
+}
+
+// Counting the valid words of an essay and merging them into the corpus counts, the CPU work of every essay
+func BenchmarkProcessEssay(b *testing.B) {
+	vocabulary := benchVocabulary(20000)
+	essay := benchEssay(vocabulary, 1000, 1)
+	wordBank := make(map[string]struct{}, len(vocabulary))
+	for _, word := range vocabulary {
+		wordBank[word] = struct{}{}
+	}
+	wc := NewWordCounter(&wordBank)
+
+	wordMap := make(map[string]int)
+	docFreq := make(map[string]int)
+	var weighted map[string]float64
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		essayWordMap := make(map[string]int)
+		wc.countValidWords(essay, &essayWordMap)
+		processEssay(&wordMap, &docFreq, &weighted, &essayWordMap, 1)
+	}
+}
+
+// Merges every word into the totals under a single mutex as it's counted, how the counts were merged before each
+// worker counted an essay into its own map
+type lockPerWordMerger struct {
+	mtx     sync.Mutex
+	wordMap map[string]int
+}
+
+func (m *lockPerWordMerger) merge(essayWordMap map[string]int) {
+	for word, count := range essayWordMap {
+		for i := 0; i < count; i++ {
+			m.mtx.Lock()
+			m.wordMap[word]++
+			m.mtx.Unlock()
+		}
+	}
+}
+
+func (m *lockPerWordMerger) counts() (map[string]int, map[string]int) {
+	return m.wordMap, nil
+}
+
+/*
+Locking the single mutex for every word against merging each worker's essay map under it once per essay, and against
+sharded maps
+
+	go test -run '^$' -bench Aggregation -benchmem -cpu 1,8
+*/
+func BenchmarkAggregation(b *testing.B) {
+	essays := benchEssayWordMaps(1000)
+	mergers := []struct {
+		name      string
+		newMerger func() countMerger
+	}{
+		{"lock-per-word", func() countMerger { return &lockPerWordMerger{wordMap: make(map[string]int)} }},
+		{"merge-per-essay", func() countMerger { return newCountMerger(MergeMutex) }},
+		{"sharded", func() countMerger { return newCountMerger(MergeSharded) }},
+	}
+	for _, m := range mergers {
+		b.Run(fmt.Sprintf("%s/workers=%d", m.name, DefaultWorkers), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				mergeEssays(m.newMerger(), essays, DefaultWorkers)
+			}
+		})
+	}
+}
+
+// Merging a corpus into word maps sized up front with the number of distinct words, like WithMapHint, against maps
+// that grow from empty
+func BenchmarkMapHint(b *testing.B) {
+	essays := benchEssayWordMaps(1000)
+	distinct := make(map[string]struct{})
+	for _, essay := range essays {
+		for word := range essay {
+			distinct[word] = struct{}{}
+		}
+	}
+
+	for _, mapHint := range []int{0, len(distinct)} {
+		b.Run(fmt.Sprintf("map-hint=%d", mapHint), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				wordMap := make(map[string]int, mapHint)
+				docFreq := make(map[string]int, mapHint)
+				var weighted map[string]float64
+				for _, essay := range essays {
+					processEssay(&wordMap, &docFreq, &weighted, &essay, 1)
+				}
+			}
+		})
+	}
+}
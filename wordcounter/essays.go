@@ -0,0 +1,146 @@
+package wordcounter
+
+import (
+	"bufio"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Read local file (or stdin if the path is "-" or empty) for list of URLs containing articles/essays.
+// Lines that aren't valid http(s) URLs are skipped and returned separately. A .json or .csv file is read as a
+// manifest instead, with a url and optional category and other metadata for each essay, see readJsonManifest and
+// readCsvManifest
+func getEssays(filePath string) (*[]Essay, []string, error) {
+	var essays []Essay
+
+	var r io.Reader = os.Stdin
+	if !isStdinPath(filePath) {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var malformed []string
+	var err error
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".json":
+		essays, malformed, err = readJsonManifest(r)
+	case ".csv":
+		essays, malformed, err = readCsvManifest(r)
+	default:
+		// Stream line by line, skipping blank lines and lines that aren't valid http(s) URLs
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			essayUrl := strings.TrimSpace(scanner.Text())
+			if essayUrl == "" {
+				continue
+			}
+			if !isValidEssayUrl(essayUrl) {
+				malformed = append(malformed, essayUrl)
+				continue
+			}
+			essays = append(essays, Essay{URL: essayUrl})
+		}
+		err = scanner.Err()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(malformed) > 0 {
+		slog.Warn("Skipped malformed essay URLs", "malformed", len(malformed))
+	}
+
+	essays, duplicates := dedupeEssays(essays)
+	if duplicates > 0 {
+		slog.Info("Removed duplicate essay URLs", "duplicates", duplicates)
+	}
+
+	return &essays, malformed, nil
+}
+
+// Whether getEssays reads the essay list at filePath from stdin
+func isStdinPath(filePath string) bool {
+	return filePath == "" || filePath == "-"
+}
+
+// Remove duplicate essay URLs keeping the first occurrence (and its metadata), so an essay listed twice isn't counted
+// twice
+func dedupeEssays(essays []Essay) ([]Essay, int) {
+	seen := make(map[string]struct{}, len(essays))
+	deduped := make([]Essay, 0, len(essays))
+	for _, essay := range essays {
+		if _, ok := seen[essay.URL]; ok {
+			continue
+		}
+		seen[essay.URL] = struct{}{}
+		deduped = append(deduped, essay)
+	}
+
+	return deduped, len(essays) - len(deduped)
+}
+
+/*
+Find the saved essay HTML files (.html or .htm) in dir and its subdirectories, returned as file:// URLs in path order.
+fetchWordsFromEssay reads file:// URLs from disk, so the rest of the pipeline is the same as for fetched essays
+*/
+func getEssayDir(dir string) (*[]Essay, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var essays []Essay
+	err = filepath.WalkDir(absDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if d.IsDir() || (ext != ".html" && ext != ".htm") {
+			return nil
+		}
+		essays = append(essays, Essay{URL: (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &essays, nil
+}
+
+// Shuffle a copy of the essays with the seed and take the first n, the essay list itself is left in order
+func sampleEssays(essays []Essay, n int, seed int64) *[]Essay {
+	sampled := make([]Essay, len(essays))
+	copy(sampled, essays)
+
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(sampled), func(i, j int) {
+		sampled[i], sampled[j] = sampled[j], sampled[i]
+	})
+
+	if n < len(sampled) {
+		sampled = sampled[:n]
+	}
+
+	return &sampled
+}
+
+// Check the essay URL is an absolute http or https URL
+func isValidEssayUrl(essayUrl string) bool {
+	u, err := url.Parse(essayUrl)
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,66 @@
+package wordcounter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Location of the cached HTML of an essay, keyed by a hash of the URL since URLs can't be used as file names
+func htmlCachePath(cacheDir string, essayUrl string) string {
+	sum := sha256.Sum256([]byte(essayUrl))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:16])+".html")
+}
+
+// Count the words of the cached HTML of an essay if it's younger than the TTL, ok is false if there is no usable
+// cache and the essay has to be fetched
+func (wc *WordCounter) readCachedEssay(essayUrl string) (essay *essayCounts, ok bool, err error) {
+	cachePath := htmlCachePath(wc.htmlCacheDir, essayUrl)
+	info, err := os.Stat(cachePath)
+	if err != nil || time.Since(info.ModTime()) >= wc.htmlCacheTTL {
+		return nil, false, nil
+	}
+
+	f, err := os.Open(cachePath)
+	if err != nil {
+		slog.Warn("Failed to read cached essay, fetching it instead", "url", essayUrl, "path", cachePath, "error", err)
+		return nil, false, nil
+	}
+	defer f.Close()
+
+	slog.Debug("Counting cached essay", "url", essayUrl, "path", cachePath)
+	essay, err = wc.countWordsInHtml(f, essayUrl)
+	return essay, true, err
+}
+
+/*
+Count the words of an essay body while writing it to the HTML cache. The body is written to a temp file and only moved
+into place once the essay was counted, so an essay that failed or a body cut short never leaves a cache entry behind
+and is fetched again next time. Failing to cache is only logged, the essay is still counted
+*/
+func (wc *WordCounter) countAndCacheEssay(body io.Reader, essayUrl string, source string) (*essayCounts, error) {
+	if err := os.MkdirAll(wc.htmlCacheDir, 0755); err != nil {
+		slog.Warn("Failed to create the HTML cache", "path", wc.htmlCacheDir, "error", err)
+		return wc.countWordsInHtml(body, source)
+	}
+	tmp, err := os.CreateTemp(wc.htmlCacheDir, "essay-*.tmp")
+	if err != nil {
+		slog.Warn("Failed to cache essay", "url", essayUrl, "error", err)
+		return wc.countWordsInHtml(body, source)
+	}
+	defer os.Remove(tmp.Name())
+
+	essay, err := wc.countWordsInHtml(io.TeeReader(body, tmp), source)
+	if closeErr := tmp.Close(); err != nil || closeErr != nil {
+		return essay, err
+	}
+
+	if err := os.Rename(tmp.Name(), htmlCachePath(wc.htmlCacheDir, essayUrl)); err != nil {
+		slog.Warn("Failed to cache essay", "url", essayUrl, "error", err)
+	}
+	return essay, nil
+}
@@ -0,0 +1,147 @@
+package wordcounter
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Essay of the essay list along with the metadata its manifest row has, only URL is set for a plain list of URLs
+type Essay struct {
+	URL string
+	// section the essay belongs to, from the manifest's category column
+	Category string
+	// the rest of the manifest row's columns keyed by name (e.g. a publish date), nil if there are none
+	Metadata map[string]string
+}
+
+// URLs of the essays in order, which is all the word counter needs to fetch them
+func essayUrls(essays []Essay) []string {
+	urls := make([]string, len(essays))
+	for i, essay := range essays {
+		urls[i] = essay.URL
+	}
+	return urls
+}
+
+/*
+Read a JSON manifest, an array of objects that each have a "url" and optionally a "category" and any other fields,
+e.g. [{"url": "https://...", "category": "gaming", "published": "2019-08-24"}]. Fields that aren't strings are kept
+as their JSON text. Rows without a valid http(s) url are returned as malformed
+*/
+func readJsonManifest(r io.Reader) ([]Essay, []string, error) {
+	var rows []map[string]any
+	if err := json.NewDecoder(r).Decode(&rows); err != nil {
+		return nil, nil, fmt.Errorf("invalid JSON manifest: %w", err)
+	}
+
+	var essays []Essay
+	var malformed []string
+	for i, row := range rows {
+		fields := make(map[string]string, len(row))
+		for key, value := range row {
+			if s, ok := value.(string); ok {
+				fields[key] = s
+				continue
+			}
+			text, err := json.Marshal(value)
+			if err != nil {
+				return nil, nil, err
+			}
+			fields[key] = string(text)
+		}
+
+		essay, ok := manifestEssay(fields)
+		if !ok {
+			malformed = append(malformed, fmt.Sprintf("row %d: %q", i+1, fields["url"]))
+			continue
+		}
+		essays = append(essays, essay)
+	}
+
+	return essays, malformed, nil
+}
+
+/*
+Read a CSV manifest, the first row is the header and must have a "url" column, a "category" column and any other
+columns are optional. Rows without a valid http(s) url are returned as malformed
+*/
+func readCsvManifest(r io.Reader) ([]Essay, []string, error) {
+	reader := csv.NewReader(r)
+	// rows may leave trailing columns out, they are treated as empty
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CSV manifest: %w", err)
+	}
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+	}
+	hasUrl := false
+	for _, column := range header {
+		hasUrl = hasUrl || column == "url"
+	}
+	if !hasUrl {
+		return nil, nil, errors.New("CSV manifest has no url column")
+	}
+
+	var essays []Essay
+	var malformed []string
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid CSV manifest: %w", err)
+		}
+
+		// blank lines are skipped by the csv reader, a row of empty columns is skipped here the same way
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+		fields := make(map[string]string, len(header))
+		for i, value := range record {
+			if i < len(header) {
+				fields[header[i]] = strings.TrimSpace(value)
+			}
+		}
+
+		essay, ok := manifestEssay(fields)
+		if !ok {
+			line, _ := reader.FieldPos(0)
+			malformed = append(malformed, fmt.Sprintf("line %d: %q", line, fields["url"]))
+			continue
+		}
+		essays = append(essays, essay)
+	}
+
+	return essays, malformed, nil
+}
+
+// Essay of a manifest row's fields, false if it has no valid http(s) url
+func manifestEssay(fields map[string]string) (Essay, bool) {
+	essay := Essay{URL: strings.TrimSpace(fields["url"]), Category: fields["category"]}
+	if !isValidEssayUrl(essay.URL) {
+		return Essay{}, false
+	}
+
+	for key, value := range fields {
+		if key == "url" || key == "category" {
+			continue
+		}
+		if essay.Metadata == nil {
+			essay.Metadata = make(map[string]string)
+		}
+		essay.Metadata[key] = value
+	}
+
+	return essay, true
+}
@@ -0,0 +1,148 @@
+package wordcounter
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+)
+
+// How the workers merge the words of each essay into the corpus counts
+type MergeMode string
+
+const (
+	// One map for the counts, each essay's words are merged in under the mutex that guards the rest of the run's state
+	MergeMutex MergeMode = "mutex"
+	// A sync.Map of atomic counters, merged without taking the run's mutex
+	MergeSyncMap MergeMode = "sync-map"
+	// The words are split over mergeShards maps by hash, each with its own mutex
+	MergeSharded MergeMode = "sharded"
+)
+
+// Number of maps the counts are split over with MergeSharded
+const mergeShards = 32
+
+// Corpus counts that several workers can merge essays into at once, the alternatives to the map and mutex of
+// countEssays. Only the counts and document frequencies are kept, see WithMergeMode for what that leaves out
+type countMerger interface {
+	merge(essayWordMap map[string]int)
+	// the counts and document frequencies merged so far
+	counts() (wordMap map[string]int, docFreq map[string]int)
+}
+
+func newCountMerger(mode MergeMode) countMerger {
+	switch mode {
+	case MergeSyncMap:
+		return &syncMapMerger{}
+	case MergeSharded:
+		merger := &shardedMerger{seed: maphash.MakeSeed()}
+		for i := range merger.shards {
+			merger.shards[i].wordMap = make(map[string]int)
+			merger.shards[i].docFreq = make(map[string]int)
+		}
+		return merger
+	default:
+		return &mutexMerger{wordMap: make(map[string]int), docFreq: make(map[string]int)}
+	}
+}
+
+// The merge countEssays does with MergeMutex, on its own so it can be benchmarked against the others
+type mutexMerger struct {
+	mtx     sync.Mutex
+	wordMap map[string]int
+	docFreq map[string]int
+}
+
+func (m *mutexMerger) merge(essayWordMap map[string]int) {
+	var weighted map[string]float64
+	m.mtx.Lock()
+	processEssay(&m.wordMap, &m.docFreq, &weighted, &essayWordMap, 1)
+	m.mtx.Unlock()
+}
+
+func (m *mutexMerger) counts() (map[string]int, map[string]int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.wordMap, m.docFreq
+}
+
+// Count and document frequency of a word with MergeSyncMap
+type atomicCount struct {
+	count   atomic.Int64
+	docFreq atomic.Int64
+}
+
+type syncMapMerger struct {
+	// word to *atomicCount
+	words sync.Map
+}
+
+func (m *syncMapMerger) merge(essayWordMap map[string]int) {
+	for word, count := range essayWordMap {
+		// Load first so a word that's already counted doesn't allocate a counter only to throw it away
+		value, ok := m.words.Load(word)
+		if !ok {
+			value, _ = m.words.LoadOrStore(word, &atomicCount{})
+		}
+		counter := value.(*atomicCount)
+		counter.count.Add(int64(count))
+		counter.docFreq.Add(1)
+	}
+}
+
+func (m *syncMapMerger) counts() (map[string]int, map[string]int) {
+	wordMap := make(map[string]int)
+	docFreq := make(map[string]int)
+	m.words.Range(func(key, value any) bool {
+		counter := value.(*atomicCount)
+		wordMap[key.(string)] = int(counter.count.Load())
+		docFreq[key.(string)] = int(counter.docFreq.Load())
+		return true
+	})
+	return wordMap, docFreq
+}
+
+type shardedMerger struct {
+	seed   maphash.Seed
+	shards [mergeShards]struct {
+		mtx     sync.Mutex
+		wordMap map[string]int
+		docFreq map[string]int
+	}
+}
+
+// The words of the essay are grouped by shard first, so each shard's mutex is only taken once per essay
+func (m *shardedMerger) merge(essayWordMap map[string]int) {
+	var byShard [mergeShards][]string
+	for word := range essayWordMap {
+		i := maphash.String(m.seed, word) % mergeShards
+		byShard[i] = append(byShard[i], word)
+	}
+
+	for i, words := range byShard {
+		if len(words) == 0 {
+			continue
+		}
+		shard := &m.shards[i]
+		shard.mtx.Lock()
+		for _, word := range words {
+			shard.wordMap[word] += essayWordMap[word]
+			shard.docFreq[word]++
+		}
+		shard.mtx.Unlock()
+	}
+}
+
+func (m *shardedMerger) counts() (map[string]int, map[string]int) {
+	wordMap := make(map[string]int)
+	docFreq := make(map[string]int)
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mtx.Lock()
+		for word, count := range shard.wordMap {
+			wordMap[word] = count
+			docFreq[word] = shard.docFreq[word]
+		}
+		shard.mtx.Unlock()
+	}
+	return wordMap, docFreq
+}
@@ -0,0 +1,108 @@
+package wordcounter
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+)
+
+var mergeModes = []MergeMode{MergeMutex, MergeSyncMap, MergeSharded}
+
+// Word maps of n essays, counted the way the workers count them
+func benchEssayWordMaps(n int) []map[string]int {
+	vocabulary := benchVocabulary(20000)
+	wc := NewWordCounter(nil)
+	essays := make([]map[string]int, n)
+	for i := range essays {
+		essays[i] = make(map[string]int)
+		wc.countValidWords(benchEssay(vocabulary, 800, int64(i)), &essays[i])
+	}
+	return essays
+}
+
+// Merge every essay with the given number of workers, each taking the next essay off a channel like countEssays
+func mergeEssays(merger countMerger, essays []map[string]int, workers int) {
+	essayCh := make(chan map[string]int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for essay := range essayCh {
+				merger.merge(essay)
+			}
+		}()
+	}
+	for _, essay := range essays {
+		essayCh <- essay
+	}
+	close(essayCh)
+	wg.Wait()
+}
+
+func TestCountMergersAgree(t *testing.T) {
+	essays := benchEssayWordMaps(200)
+	wantWordMap, wantDocFreq := map[string]int{}, map[string]int{}
+	var weighted map[string]float64
+	for _, essay := range essays {
+		processEssay(&wantWordMap, &wantDocFreq, &weighted, &essay, 1)
+	}
+
+	for _, mode := range mergeModes {
+		t.Run(string(mode), func(t *testing.T) {
+			merger := newCountMerger(mode)
+			mergeEssays(merger, essays, 16)
+			wordMap, docFreq := merger.counts()
+			if !maps.Equal(wordMap, wantWordMap) || !maps.Equal(docFreq, wantDocFreq) {
+				t.Errorf("counts differ from merging one essay at a time: %d words, want %d", len(wordMap), len(wantWordMap))
+			}
+		})
+	}
+}
+
+/*
+Merging 1000 essays of 800 words with many workers at once. Run it with several GOMAXPROCS to see the lock
+contention, e.g.
+
+	go test -run '^$' -bench Merge -benchmem -cpu 1,4,8
+*/
+func BenchmarkMerge(b *testing.B) {
+	essays := benchEssayWordMaps(1000)
+	for _, mode := range mergeModes {
+		for _, workers := range []int{8, 64, 256} {
+			b.Run(fmt.Sprintf("%s/workers=%d", mode, workers), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					mergeEssays(newCountMerger(mode), essays, workers)
+				}
+			})
+		}
+	}
+}
+
+func TestCountWithMergeMode(t *testing.T) {
+	server := newEssayServer(t, map[string]string{
+		"/first":  ldJsonPage("The cat sat on the mat with another cat"),
+		"/second": ldJsonPage("A cat and a dog"),
+	}, nil)
+	urls := []string{server.URL + "/first", server.URL + "/second"}
+
+	want, err := newTestCounter(nil).Count(context.Background(), urls)
+	if err != nil {
+		t.Fatalf("Count() error = %v", err)
+	}
+	for _, mode := range mergeModes[1:] {
+		t.Run(string(mode), func(t *testing.T) {
+			result, err := newTestCounter(nil, WithMergeMode(mode)).Count(context.Background(), urls)
+			if err != nil {
+				t.Fatalf("Count() error = %v", err)
+			}
+			if !slices.Equal(result.Words, want.Words) {
+				t.Errorf("words = %+v, want %+v", result.Words, want.Words)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package wordcounter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics of serve mode. They are kept on their own registry rather than the global one so a one-shot run
+// registers nothing, and /metrics only has the counter's metrics and the Go runtime's
+type metrics struct {
+	registry *prometheus.Registry
+
+	essaysFetched prometheus.Counter
+	// failed essays by the same reason as the failures report, e.g. "rate limited" or "no articleBody"
+	fetchFailures *prometheus.CounterVec
+	// 429 and 503 responses, an essay that is retried until it succeeds can hit the rate limit several times
+	rateLimitHits prometheus.Counter
+	fetchDuration prometheus.Histogram
+	// POST /count requests by response status code
+	requests *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		essaysFetched: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "word_counter_essays_fetched_total",
+			Help: "Essays that were fetched and counted.",
+		}),
+		fetchFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "word_counter_essay_fetch_failures_total",
+			Help: "Essays that failed to be fetched or parsed, by reason.",
+		}, []string{"reason"}),
+		rateLimitHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "word_counter_rate_limit_hits_total",
+			Help: "Essay responses that were rate limited (429 or 503), including ones that were retried.",
+		}),
+		fetchDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "word_counter_essay_fetch_duration_seconds",
+			Help: "Time taken to fetch and count an essay, including rate limit retries but not the request delay.",
+			// essays take from a few hundred milliseconds to tens of seconds when they are retried
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "word_counter_count_requests_total",
+			Help: "POST /count requests, by status code.",
+		}, []string{"code"}),
+	}
+
+	m.registry.MustRegister(m.essaysFetched, m.fetchFailures, m.rateLimitHits, m.fetchDuration, m.requests,
+		prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+
+	return m
+}
+
+// Record an essay fetch that took duration, essays aborted because their request was cancelled aren't recorded
+func (m *metrics) observeFetch(duration time.Duration, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	m.fetchDuration.Observe(duration.Seconds())
+	if err != nil {
+		m.fetchFailures.WithLabelValues(failureReason(err)).Inc()
+		return
+	}
+	m.essaysFetched.Inc()
+}
+
+// Wrap the /count handler to count its requests by status code
+func (m *metrics) instrumentCount(handler http.HandlerFunc) http.Handler {
+	return promhttp.InstrumentHandlerCounter(m.requests, handler)
+}
+
+// Handler of /metrics in the Prometheus text format
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,475 @@
+package wordcounter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+/*
+Config of a one-shot run, main fills it in from the command line flags once they are validated so each field has the
+meaning of the flag with the same name. Tests can build one directly instead, e.g. pointing WordBanks at a local file
+and EssaysPath at a list of URLs served by an httptest server.
+*/
+type Config struct {
+	// word bank sources (URLs or files) merged into one, the default word bank URL if empty
+	WordBanks   []string
+	NoBank      bool
+	NoFallback  bool
+	WordBankTTL time.Duration
+	// timeout of each attempt at downloading a word bank, the essay Timeout if 0
+	WordBankTimeout time.Duration
+	RefreshWordBank bool
+
+	StopwordsPath string
+	// count the words of the built-in stopword list, which are excluded by default
+	NoBuiltinStopwords bool
+	Exclude            []string
+	ExcludeFile        string
+
+	// essays are read from EssayDir when it's set, otherwise from the URL list in EssaysPath ("-" for stdin)
+	EssaysPath  string
+	EssayDir    string
+	LimitEssays int
+	Sample      int
+	// seed for Sample, 0 picks a random one
+	Seed   int64
+	DryRun bool
+	// one worker fetching the essays in file order without the random delay, and a fixed seed for Sample, so runs
+	// over the same essays give the same result. Slow, it's meant for tests and reproducibility
+	Deterministic bool
+
+	Timeout             time.Duration
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+	UserAgent           string
+	Headers             http.Header
+	NoFollowRedirects   bool
+	Workers             int
+	AutoWorkers         bool
+	MaxRetries          int
+	NetworkRetries      int
+	MinDelay            time.Duration
+	MaxDelay            time.Duration
+	RPS                 float64
+	MaxBodySize         int64
+	// directory essay HTML is cached in and for how long, no cache if empty
+	HTMLCache    string
+	HTMLCacheTTL time.Duration
+
+	MinLength int
+	Unicode   bool
+	// pattern of a valid word, overrides MinLength and Unicode when it's set
+	TokenRegex *regexp.Regexp
+	Top        int
+	MinCount   int
+	// share of all valid words in percent a word needs to be in Result.FrequentWords, 0 for none
+	MinFreqPercent float64
+	MinEssayWords  int
+	Stem           bool
+	TextFallback   bool
+	// ld+json keys the essay body is read from in order, just articleBody if empty
+	BodyFields      []string
+	Ngram           int
+	SkipInvalidUTF8 bool
+	Rank            Rank
+	Normalize       Normalize
+	Order           Order
+	Sort            SortBy
+	GroupBy         GroupBy
+	RecencyWeight   time.Duration
+	// time essay ages are measured from for RecencyWeight
+	RecencyFrom time.Time
+	MapHint     int
+	Merge       MergeMode
+
+	Checkpoint      string
+	CheckpointEvery int
+	PerEssay        bool
+	// also count the words of each category of the essay manifest apart, for Result.Categories
+	ByCategory bool
+	// file the counts of every word are saved to after the run, and the saved counts sorted instead of counting essays
+	SaveCounts string
+	LoadCounts string
+	// sample the goroutines and heap while the essays are counted and add their peaks to the summary, along with the
+	// length statistics of the valid words
+	Stats bool
+	// log a line for every essay as it's done, with its status, size, fetch and parse time and valid words
+	Trace bool
+
+	// called with the top words so far every Stream interval, e.g. to write them out as they come in
+	Stream     time.Duration
+	OnSnapshot func(*Result)
+
+	// largest request body in bytes and most essay URLs of each POST /count request with Serve, 0 for no limit
+	ServeMaxBody int64
+	ServeMaxUrls int
+}
+
+/*
+Run loads the word bank, stopwords and essays described by the config, counts the essays and returns the sorted top
+words and summary, along with the essays that failed and (with PerEssay) each essay's own top words. Writing the
+result out is left to the caller. With LoadCounts the counts saved by an earlier run are sorted instead, and nothing
+is fetched.
+
+When the context is cancelled the partial result is returned with the context's error. A dry run only loads and
+checks the inputs and returns a nil result, with an error if the essay list has malformed URLs. A word bank that can't
+be loaded at all stops the run and is returned as an error with a nil result.
+*/
+func Run(ctx context.Context, cfg Config) (*Result, error) {
+	counterOpts, err := cfg.counterOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Saved counts are only sorted again, there are no essays to load and the word bank isn't needed
+	if cfg.LoadCounts != "" {
+		counterOpts = append(counterOpts, WithWordBankLoader(nil))
+		result, err := NewWordCounter(nil, counterOpts...).CountFromSaved(cfg.LoadCounts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load counts %q: %w", cfg.LoadCounts, err)
+		}
+		return result, nil
+	}
+
+	essays, malformed, err := cfg.loadEssays()
+	if err != nil {
+		return nil, err
+	}
+
+	// Dry run stops before any essay is fetched, failing if the essay list has malformed URLs so they can be fixed first
+	if cfg.DryRun {
+		if err := NewWordCounter(nil, counterOpts...).waitForWordBank(); err != nil {
+			return nil, err
+		}
+		for _, line := range malformed {
+			slog.Warn("Malformed essay URL", "line", line)
+		}
+		if len(malformed) > 0 {
+			return nil, fmt.Errorf("dry run found %d malformed essay URLs", len(malformed))
+		}
+		slog.Info("Dry run OK", "essays", len(*essays))
+		return nil, nil
+	}
+
+	// essays that failed to fetch or parse along with the reason
+	failures := make([]EssayFailure, 0)
+	counterOpts = append(counterOpts, WithFailureHandler(func(failure EssayFailure) {
+		failures = append(failures, failure)
+	}))
+
+	// word counts of each essay keyed by essay URL, only filled when PerEssay is set
+	essayWordMaps := make(map[string]map[string]int)
+	if cfg.PerEssay {
+		counterOpts = append(counterOpts, WithEssayHandler(func(essayUrl string, essayWordMap map[string]int) {
+			essayWordMaps[essayUrl] = essayWordMap
+		}))
+	}
+
+	// categories come from the manifest, essays from a plain list of URLs or EssayDir have none
+	if cfg.ByCategory {
+		categories := make(map[string]string)
+		for _, essay := range *essays {
+			if essay.Category != "" {
+				categories[essay.URL] = essay.Category
+			}
+		}
+		if len(categories) == 0 {
+			slog.Warn("No essay has a category, -by-category needs a manifest with a category column")
+		}
+		counterOpts = append(counterOpts, WithCategories(categories))
+	}
+
+	if cfg.Stream > 0 && cfg.OnSnapshot != nil {
+		counterOpts = append(counterOpts, WithSnapshotHandler(cfg.Stream, cfg.OnSnapshot))
+	}
+
+	if cfg.Checkpoint != "" {
+		counterOpts = append(counterOpts, WithCheckpoint(cfg.Checkpoint, cfg.CheckpointEvery))
+	}
+	if cfg.SaveCounts != "" {
+		counterOpts = append(counterOpts, WithSaveCounts(cfg.SaveCounts))
+	}
+
+	var stopStats func() RuntimeStats
+	if cfg.Stats {
+		stopStats = sampleRuntimeStats(statsInterval)
+	}
+
+	// words are a slice rather than a map so the output keeps the descending count order
+	result, err := NewWordCounter(nil, counterOpts...).Count(ctx, essayUrls(*essays))
+	if result == nil {
+		return nil, err
+	}
+
+	if stopStats != nil {
+		stats := stopStats()
+		result.Summary.Stats = &stats
+		slog.Info("Runtime stats", "peak_goroutines", stats.PeakGoroutines, "peak_heap_bytes", stats.PeakHeapBytes)
+	}
+
+	slog.Info("Phase timings", "word_bank_ms", result.Summary.Timings.WordBankMs,
+		"fetch_ms", result.Summary.Timings.FetchMs, "sort_ms", result.Summary.Timings.SortMs)
+
+	result.Failures = failures
+	if cfg.PerEssay {
+		result.Essays = make(map[string][]WordCount, len(essayWordMaps))
+		for essayUrl, essayWordMap := range essayWordMaps {
+			// percentages of an essay's words are of that essay's own total, and -min-count only applies to the words
+			// across all essays since a single essay has too few words for it
+			essayWords := sortWordMap(&essayWordMap, cfg.Top, 0, nil, cfg.Sort, cfg.Order == OrderAsc)
+			addPercentages(essayWords, totalWords(&essayWordMap))
+			result.Essays[essayUrl] = *essayWords
+		}
+	}
+
+	return result, err
+}
+
+// Seed of Sample with Deterministic when no Seed is given
+const deterministicSeed int64 = 1
+
+// How often the runtime stats are sampled, ReadMemStats stops the world briefly so it isn't done continuously
+const statsInterval = 100 * time.Millisecond
+
+// Sample the number of goroutines and the heap every interval in the background until the returned stop function
+// is called, which takes a last sample and returns the peaks
+func sampleRuntimeStats(interval time.Duration) func() RuntimeStats {
+	var stats RuntimeStats
+	sample := func() {
+		stats.PeakGoroutines = max(stats.PeakGoroutines, runtime.NumGoroutine())
+		var memStats runtime.MemStats
+		runtime.ReadMemStats(&memStats)
+		stats.PeakHeapBytes = max(stats.PeakHeapBytes, memStats.HeapAlloc)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				sample()
+			}
+		}
+	}()
+
+	return func() RuntimeStats {
+		close(done)
+		<-stopped
+		sample()
+		return stats
+	}
+}
+
+/*
+Transport tuned for thousands of requests to the same host. The default transport only keeps 2 idle connections per
+host, so most workers would open a new connection (and do a new TLS handshake) for every essay, instead every worker
+gets an idle connection to reuse. Keep-alives stay on and HTTP/2 is used when the server supports it
+*/
+func newTransport(maxIdleConnsPerHost, maxConnsPerHost int, idleConnTimeout time.Duration) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	// the total idle limit would otherwise cap the per host one
+	transport.MaxIdleConns = max(transport.MaxIdleConns, maxIdleConnsPerHost)
+	transport.MaxConnsPerHost = maxConnsPerHost
+	transport.IdleConnTimeout = idleConnTimeout
+	transport.DisableKeepAlives = false
+	transport.ForceAttemptHTTP2 = true
+	return transport
+}
+
+// Options of the word counter for the config, shared by a one-shot run and serve mode. The word bank download is
+// aborted when the context is cancelled
+func (cfg Config) counterOptions(ctx context.Context) ([]Option, error) {
+	// Shared HTTP client used for both the word bank download and essay fetches
+	client := &http.Client{Timeout: cfg.Timeout, Transport: newTransport(cfg.MaxIdleConnsPerHost, cfg.MaxConnsPerHost, cfg.IdleConnTimeout)}
+
+	// Word banks are cached on disk so repeated runs don't need to download them again, caching is skipped if there is no cache dir
+	cacheDir, err := wordBankCacheDir()
+	if err != nil {
+		slog.Warn("Word bank will not be cached", "error", err)
+	}
+
+	// Get the word banks and merge them into one, defaults to the URL given in assignment
+	// Without a word bank every word matching the regex is counted, so there is nothing to download
+	wordBankSources := cfg.WordBanks
+	if cfg.NoBank {
+		if len(wordBankSources) > 0 {
+			slog.Warn("-wordbank is ignored with -no-bank")
+		}
+		slog.Info("Counting every word, the word bank is not used")
+	}
+	if len(wordBankSources) == 0 {
+		wordBankSources = []string{WordBankUrl}
+	}
+	// the word bank has its own timeout on the same connections, it's much larger than an essay
+	wordBankClient := client
+	if cfg.WordBankTimeout > 0 {
+		wordBankClient = &http.Client{Timeout: cfg.WordBankTimeout, Transport: client.Transport}
+	}
+	loadWordBank := func() (*map[string]struct{}, error) {
+		if cfg.NoBank {
+			return nil, nil
+		}
+		return loadWordBanks(ctx, wordBankClient, wordBankSources, cacheDir, cfg.WordBankTTL, cfg.RefreshWordBank, cfg.NoFallback)
+	}
+
+	// Stopwords are stored the same way as the word bank, any word in it is not counted
+	stopwords := &map[string]struct{}{}
+	if !cfg.NoBuiltinStopwords {
+		stopwords, err = scanWordBank(strings.NewReader(BuiltinStopwords))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load built-in stopwords: %w", err)
+		}
+	}
+	if cfg.StopwordsPath != "" {
+		fileStopwords, err := readWordBankFile(cfg.StopwordsPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load stopwords %q: %w", cfg.StopwordsPath, err)
+		}
+		for word := range *fileStopwords {
+			(*stopwords)[word] = struct{}{}
+		}
+	}
+	if len(*stopwords) > 0 {
+		slog.Info("Loaded stopwords", "words", len(*stopwords))
+	}
+
+	// Excluded words are kept apart from the stopwords, they are site specific boilerplate rather than common words
+	excluded := &map[string]struct{}{}
+	if cfg.ExcludeFile != "" {
+		excluded, err = readWordBankFile(cfg.ExcludeFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load excluded words %q: %w", cfg.ExcludeFile, err)
+		}
+	}
+	for _, word := range cfg.Exclude {
+		(*excluded)[strings.ToLower(strings.TrimSpace(word))] = struct{}{}
+	}
+	if len(*excluded) > 0 {
+		slog.Info("Loaded excluded words", "words", len(*excluded))
+	}
+
+	// 0 keeps the fixed number of workers
+	workers, maxAdaptiveWorkers := cfg.Workers, 0
+	if cfg.AutoWorkers {
+		maxAdaptiveWorkers = cfg.Workers
+	}
+
+	// a single worker counts the essays one at a time in file order, and without jitter nothing depends on timing
+	minDelay, maxDelay := cfg.MinDelay, cfg.MaxDelay
+	if cfg.Deterministic {
+		workers, maxAdaptiveWorkers = 1, 0
+		minDelay, maxDelay = 0, 0
+	}
+
+	headers := cfg.Headers.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	if cfg.UserAgent != "" {
+		headers.Set("User-Agent", cfg.UserAgent)
+	}
+
+	return []Option{
+		WithHTTPClient(client),
+		WithStopwords(stopwords),
+		WithExclude(excluded),
+		WithMinWordLength(cfg.MinLength),
+		WithUnicode(cfg.Unicode),
+		// nil keeps the regex built from the min length and unicode
+		WithRegexp(cfg.TokenRegex),
+		WithWorkers(workers),
+		WithAdaptiveWorkers(maxAdaptiveWorkers),
+		WithMaxRetries(cfg.MaxRetries),
+		WithNetworkRetries(cfg.NetworkRetries),
+		WithDelay(minDelay, maxDelay),
+		WithRateLimit(cfg.RPS),
+		WithHeaders(headers),
+		WithTop(cfg.Top),
+		WithMinCount(cfg.MinCount),
+		WithMinFreqPercent(cfg.MinFreqPercent),
+		WithMinEssayWords(cfg.MinEssayWords),
+		WithStemming(cfg.Stem),
+		WithTextFallback(cfg.TextFallback),
+		WithBodyFields(cfg.BodyFields...),
+		WithNgram(cfg.Ngram),
+		WithSkipInvalidUTF8(cfg.SkipInvalidUTF8),
+		WithRank(cfg.Rank),
+		WithNormalize(cfg.Normalize),
+		WithWordStats(cfg.Stats),
+		WithTrace(cfg.Trace),
+		WithRecencyWeight(cfg.RecencyWeight, cfg.RecencyFrom),
+		WithOrder(cfg.Order),
+		WithSortBy(cfg.Sort),
+		WithGroupBy(cfg.GroupBy),
+		WithMapHint(cfg.MapHint),
+		WithMergeMode(cfg.Merge),
+		WithMaxBodySize(cfg.MaxBodySize),
+		WithHTMLCache(cfg.HTMLCache, cfg.HTMLCacheTTL),
+		WithFollowRedirects(!cfg.NoFollowRedirects),
+		// the word bank is loaded in the background while the first essays are fetched, the two are independent waits
+		WithWordBankLoader(loadWordBank),
+	}, nil
+}
+
+// Whether the run reads its essay list from stdin, so stdin can't be used for anything else (e.g. -interactive). Saved
+// counts and EssayDir don't read the essay list at all
+func (cfg Config) ReadsStdin() bool {
+	return cfg.LoadCounts == "" && cfg.EssayDir == "" && isStdinPath(cfg.EssaysPath)
+}
+
+// Get the list of essay URLs, or the saved essays in EssayDir for an offline run, limited or sampled and with the
+// lines of the list that aren't valid URLs
+func (cfg Config) loadEssays() (*[]Essay, []string, error) {
+	var essays *[]Essay
+	var malformed []string
+	var err error
+	if cfg.EssayDir != "" {
+		essays, err = getEssayDir(cfg.EssayDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load essays from %q: %w", cfg.EssayDir, err)
+		}
+	} else {
+		essays, malformed, err = getEssays(cfg.EssaysPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load essays from %q: %w", cfg.EssaysPath, err)
+		}
+	}
+
+	// A random sample is more representative than the first N essays, so Sample wins over LimitEssays
+	if cfg.Sample > 0 {
+		if cfg.LimitEssays > 0 {
+			slog.Warn("-limit-essays is ignored when -sample is set")
+		}
+		seed := cfg.Seed
+		if seed == 0 && cfg.Deterministic {
+			seed = deterministicSeed
+		} else if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		essays = sampleEssays(*essays, cfg.Sample, seed)
+		// the seed is logged so a random sample can be repeated with -seed
+		slog.Info("Sampled essays", "sample", cfg.Sample, "seed", seed)
+	} else if cfg.LimitEssays > 0 && len(*essays) > cfg.LimitEssays {
+		// Limit is applied after dedup so it's the first N distinct essays
+		limited := (*essays)[:cfg.LimitEssays]
+		essays = &limited
+		slog.Info("Limited essays", "limit", cfg.LimitEssays)
+	}
+	slog.Info("Loaded essays", "essays", len(*essays))
+
+	return essays, malformed, nil
+}
@@ -0,0 +1,155 @@
+package wordcounter
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Config of a run over the essays in essaysPath with the word bank file at wordBankPath, the flags' defaults
+// otherwise but without the delay and retries so the test is quick
+func testConfig(wordBankPath, essaysPath string) Config {
+	return Config{
+		WordBanks:       []string{wordBankPath},
+		NoFallback:      true,
+		EssaysPath:      essaysPath,
+		Timeout:         5 * time.Second,
+		Workers:         4,
+		NetworkRetries:  1,
+		MaxBodySize:     DefaultMaxBodySize,
+		MinLength:       3,
+		Top:             10,
+		Ngram:           1,
+		Rank:            RankCount,
+		Normalize:       NormalizeNone,
+		Order:           OrderDesc,
+		Sort:            SortCount,
+		GroupBy:         GroupNone,
+		Merge:           MergeMutex,
+		CheckpointEvery: 100,
+	}
+}
+
+// Write the lines to a file in the test's temp dir and return its path
+func writeLines(t *testing.T, name string, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRun(t *testing.T) {
+	server := newEssayServer(t, map[string]string{
+		"/first":   ldJsonPage("The cat sat on the mat with another cat"),
+		"/second":  ldJsonPage("A cat and a dog"),
+		"/third":   ldJsonPage("The dog barked at the zebra"),
+		"/no-body": `<html><body><p>no ld+json here</p></body></html>`,
+	}, map[string]int{"/limited": http.StatusTooManyRequests})
+
+	// zebra is left out of the word bank, so it's never counted
+	wordBankPath := writeLines(t, "words.txt", "cat", "mat", "dog", "the", "sat", "barked", "another")
+	essaysPath := writeLines(t, "essays.txt",
+		server.URL+"/first", server.URL+"/second", server.URL+"/third", server.URL+"/no-body",
+		server.URL+"/limited", "not a url")
+
+	cfg := testConfig(wordBankPath, essaysPath)
+	cfg.Top = 3
+	result, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	// "the" is in the word bank but also a built-in stopword, which are left out by default
+	want := []WordCount{
+		{Word: "cat", Count: 3, DocFreq: 2, Percent: 33.33333333333333},
+		{Word: "dog", Count: 2, DocFreq: 2, Percent: 22.22222222222222},
+		{Word: "another", Count: 1, DocFreq: 1, Percent: 11.11111111111111},
+	}
+	if !reflect.DeepEqual(result.Words, want) {
+		t.Errorf("Words = %+v, want %+v", result.Words, want)
+	}
+
+	summary := result.Summary
+	if summary.TotalWords != 9 || summary.DistinctWords != 6 {
+		t.Errorf("total words = %d, distinct words = %d, want 9 and 6", summary.TotalWords, summary.DistinctWords)
+	}
+	// the malformed line is skipped when the essays are loaded, it isn't processed
+	if summary.EssaysProcessed != 5 || summary.EssaysFailed != 2 || summary.EssaysRateLimited != 1 {
+		t.Errorf("processed = %d, failed = %d, rate limited = %d, want 5, 2 and 1",
+			summary.EssaysProcessed, summary.EssaysFailed, summary.EssaysRateLimited)
+	}
+	if len(result.Failures) != 2 {
+		t.Errorf("Failures = %v, want the essay without a body and the rate limited one", result.Failures)
+	}
+}
+
+func TestRunNoBuiltinStopwords(t *testing.T) {
+	server := newEssayServer(t, map[string]string{"/essay": ldJsonPage("The cat and the dog")}, nil)
+	wordBankPath := writeLines(t, "words.txt", "cat", "dog", "the", "and")
+	essaysPath := writeLines(t, "essays.txt", server.URL+"/essay")
+
+	for _, tt := range []struct {
+		noBuiltinStopwords bool
+		want               []string
+	}{
+		{false, []string{"cat", "dog"}},
+		{true, []string{"the", "and", "cat", "dog"}},
+	} {
+		cfg := testConfig(wordBankPath, essaysPath)
+		cfg.NoBuiltinStopwords = tt.noBuiltinStopwords
+		result, err := Run(context.Background(), cfg)
+		if err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		var got []string
+		for _, word := range result.Words {
+			got = append(got, word.Word)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("NoBuiltinStopwords %t: words = %v, want %v", tt.noBuiltinStopwords, got, tt.want)
+		}
+	}
+}
+
+// A cancelled run still returns what it counted, along with the context's error
+func TestRunCancelled(t *testing.T) {
+	server := newEssayServer(t, map[string]string{"/essay": ldJsonPage("the cat")}, nil)
+	wordBankPath := writeLines(t, "words.txt", "cat", "the")
+	essaysPath := writeLines(t, "essays.txt", server.URL+"/essay")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := Run(ctx, testConfig(wordBankPath, essaysPath))
+	if err == nil {
+		t.Fatal("Run() error = nil, want the context's error")
+	}
+	if result == nil {
+		t.Fatal("Run() result = nil, want the partial result")
+	}
+}
+
+func TestConfigReadsStdin(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want bool
+	}{
+		{"dash", Config{EssaysPath: "-"}, true},
+		{"empty path", Config{}, true},
+		{"file", Config{EssaysPath: "essays.txt"}, false},
+		{"essay dir", Config{EssayDir: "./essays"}, false},
+		{"saved counts", Config{LoadCounts: "counts.json"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.cfg.ReadsStdin(); got != tt.want {
+			t.Errorf("%s: ReadsStdin() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
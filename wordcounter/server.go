@@ -0,0 +1,143 @@
+package wordcounter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Body of a POST /count request, top defaults to the counter's top when not set
+type CountRequest struct {
+	Urls []string `json:"urls"`
+	Top  int      `json:"top"`
+}
+
+// Serve the word counter set up from the config over HTTP on addr until the context is cancelled, see serveWordCounter.
+// The essays of each request come from its body, so the config's essay and output fields are not used
+func Serve(ctx context.Context, addr string, cfg Config) error {
+	counterOpts, err := cfg.counterOptions(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to set up the word counter: %w", err)
+	}
+	// the counter records its essay fetches in the same metrics the server exposes on /metrics
+	metrics := newMetrics()
+	counterOpts = append(counterOpts, withMetrics(metrics))
+	limits := serveLimits{maxBody: cfg.ServeMaxBody, maxUrls: cfg.ServeMaxUrls}
+	return serveWordCounter(ctx, addr, NewWordCounter(nil, counterOpts...), metrics, limits)
+}
+
+// Limits on each POST /count request, 0 for no limit
+type serveLimits struct {
+	// bytes of the request body
+	maxBody int64
+	// essay URLs in the request
+	maxUrls int
+}
+
+/*
+Serve the word counter over HTTP until the context is cancelled. POST /count fetches the essays in the request body
+with the same pipeline as a one-shot run and responds with the sorted top words. Each request gets its own worker
+pool of the counter's workers, and the client timeout applies to every essay fetch. Requests over the limits are
+rejected with a 413 before any essay is fetched. GET /metrics serves the metrics
+of the requests and essay fetches for Prometheus to scrape.
+*/
+func serveWordCounter(ctx context.Context, addr string, counter *WordCounter, metrics *metrics, limits serveLimits) error {
+	mux := http.NewServeMux()
+	mux.Handle("/count", metrics.instrumentCount(func(w http.ResponseWriter, r *http.Request) {
+		handleCount(w, r, counter, limits)
+	}))
+	mux.Handle("/metrics", metrics.handler())
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// Shut the server down once we are interrupted, giving in-flight requests a moment to finish
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Failed to shut down server", "error", err)
+		}
+	}()
+
+	slog.Info("Serving word counter", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// Handle POST /count, the essays are cancelled if the client goes away
+func handleCount(w http.ResponseWriter, r *http.Request, counter *WordCounter, limits serveLimits) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := r.Body
+	if limits.maxBody > 0 {
+		body = http.MaxBytesReader(w, r.Body, limits.maxBody)
+	}
+	var countRequest CountRequest
+	if err := json.NewDecoder(body).Decode(&countRequest); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("request body is larger than %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limits.maxUrls > 0 && len(countRequest.Urls) > limits.maxUrls {
+		http.Error(w, fmt.Sprintf("too many essay URLs, at most %d per request", limits.maxUrls), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if countRequest.Top == 0 {
+		countRequest.Top = counter.top
+	}
+	if countRequest.Top < 0 {
+		http.Error(w, "top must be a positive number", http.StatusBadRequest)
+		return
+	}
+
+	essays := make([]Essay, 0, len(countRequest.Urls))
+	for _, essayUrl := range countRequest.Urls {
+		if !isValidEssayUrl(essayUrl) {
+			http.Error(w, "invalid essay URL: "+essayUrl, http.StatusBadRequest)
+			return
+		}
+		essays = append(essays, Essay{URL: essayUrl})
+	}
+
+	essays, _ = dedupeEssays(essays)
+
+	// copy the counter so the requested top doesn't change it for other requests
+	requestCounter := *counter
+	requestCounter.top = countRequest.Top
+	topWords, err := requestCounter.CountFromURLs(r.Context(), essayUrls(essays))
+	if err != nil {
+		// the client went away, there is no one to respond to
+		if r.Context().Err() != nil {
+			return
+		}
+		slog.Error("Failed to count essays", "error", err)
+		http.Error(w, "failed to count essays: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(topWords); err != nil {
+		slog.Warn("Failed to write response", "error", err)
+	}
+}
@@ -0,0 +1,81 @@
+package wordcounter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Response of handleCount to a POST /count with the body
+func postCount(counter *WordCounter, limits serveLimits, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handleCount(recorder, httptest.NewRequest(http.MethodPost, "/count", strings.NewReader(body)), counter, limits)
+	return recorder
+}
+
+// JSON body of a POST /count for the URLs
+func countBody(t *testing.T, urls []string) string {
+	t.Helper()
+	body, err := json.Marshal(CountRequest{Urls: urls})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestHandleCount(t *testing.T) {
+	server := newEssayServer(t, map[string]string{"/essay": ldJsonPage("the cat and the dog")}, nil)
+	counter := newTestCounter(&map[string]struct{}{"the": {}, "cat": {}, "dog": {}})
+	limits := serveLimits{maxBody: 1 << 10, maxUrls: 3}
+
+	recorder := postCount(counter, limits, countBody(t, []string{server.URL + "/essay"}))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", recorder.Code, recorder.Body)
+	}
+	var words []WordCount
+	if err := json.NewDecoder(recorder.Body).Decode(&words); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, word := range words {
+		got = append(got, word.Word)
+	}
+	if want := []string{"the", "cat", "dog"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("words = %v, want %v", got, want)
+	}
+}
+
+func TestHandleCountLimits(t *testing.T) {
+	// no essay is fetched when a request is over the limits, so the URLs don't need to exist
+	urls := make([]string, 4)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://127.0.0.1:1/essay-%d", i)
+	}
+	counter := newTestCounter(nil)
+
+	t.Run("too many urls", func(t *testing.T) {
+		recorder := postCount(counter, serveLimits{maxUrls: 3}, countBody(t, urls))
+		if recorder.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("status = %d, want 413: %s", recorder.Code, recorder.Body)
+		}
+	})
+
+	t.Run("body too large", func(t *testing.T) {
+		body := countBody(t, urls)
+		recorder := postCount(counter, serveLimits{maxBody: int64(len(body) - 1)}, body)
+		if recorder.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("status = %d, want 413: %s", recorder.Code, recorder.Body)
+		}
+	})
+
+	t.Run("invalid body", func(t *testing.T) {
+		recorder := postCount(counter, serveLimits{maxBody: 1 << 10, maxUrls: 3}, "{")
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want 400: %s", recorder.Code, recorder.Body)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package wordcounter
+
+import (
+	"container/heap"
+	"sort"
+	"unicode/utf8"
+)
+
+type WordCount struct {
+	Word  string `json:"word"`
+	Count int    `json:"count"`
+	// number of essays the word appears in, to tell a word used often in a few essays from one used across many.
+	// Not set for the words of a single essay
+	DocFreq int `json:"doc_freq,omitempty"`
+	// score the words were ranked by, the TF-IDF score with -rank tfidf, the normalized count with -normalize and the
+	// recency weighted count with -recency-weight. Not set when words are ranked by count
+	Score float64 `json:"score,omitempty"`
+	// percentage of all valid words this word makes up
+	Percent float64 `json:"percent"`
+}
+
+// Top N words of the word map, e.g. Result.Counts, by count with ties broken alphabetically like the output of a run
+// with the default rank and sort
+func TopWords(wordMap map[string]int, top int) []WordCount {
+	return *sortWordMap(&wordMap, top, 0, nil, SortCount, false)
+}
+
+// Sort wordMap by value and return only the top N words, if N is larger than the number of words then all words are returned.
+// If score is set words are sorted by their score first, e.g. TF-IDF, and it is included in the output.
+// With SortLength longer words come first, then the rest as usual.
+// With ascending the least frequent (or lowest scoring, or shortest) words come first instead, ties are still broken alphabetically.
+func sortWordMap(wordMap *map[string]int, top int, minCount int, score func(word string, count int) float64, sortBy SortBy, ascending bool) *[]WordCount {
+	// ties are broken alphabetically so the output is the same on every run
+	ranksBefore := func(a, b WordCount) bool {
+		if sortBy == SortLength {
+			if lengthA, lengthB := utf8.RuneCountInString(a.Word), utf8.RuneCountInString(b.Word); lengthA != lengthB {
+				return (lengthA > lengthB) != ascending
+			}
+		}
+		if a.Score != b.Score {
+			return (a.Score > b.Score) != ascending
+		}
+		if a.Count != b.Count {
+			return (a.Count > b.Count) != ascending
+		}
+		return a.Word < b.Word
+	}
+
+	// Only the top N words are kept in a heap with the lowest ranked of them at the root, so selecting them is
+	// O(V log N) instead of sorting every distinct word
+	// never nil, so no words are an empty array in the JSON output rather than null
+	kept := &wordHeap{words: []WordCount{}, ranksBefore: ranksBefore}
+	for k, v := range *wordMap {
+		// rare words are dropped before sorting so the top N is picked from the words that are left
+		if v < minCount {
+			continue
+		}
+		wordCount := WordCount{Word: k, Count: v}
+		if score != nil {
+			wordCount.Score = score(k, v)
+		}
+
+		if kept.Len() < top {
+			heap.Push(kept, wordCount)
+		} else if top > 0 && ranksBefore(wordCount, kept.words[0]) {
+			kept.words[0] = wordCount
+			heap.Fix(kept, 0)
+		}
+	}
+
+	topWords := kept.words
+	sort.Slice(topWords, func(i, j int) bool {
+		return ranksBefore(topWords[i], topWords[j])
+	})
+
+	return &topWords
+}
+
+// Heap of words with the lowest ranked word at the root, for container/heap
+type wordHeap struct {
+	words       []WordCount
+	ranksBefore func(a, b WordCount) bool
+}
+
+func (h *wordHeap) Len() int           { return len(h.words) }
+func (h *wordHeap) Less(i, j int) bool { return h.ranksBefore(h.words[j], h.words[i]) }
+func (h *wordHeap) Swap(i, j int)      { h.words[i], h.words[j] = h.words[j], h.words[i] }
+func (h *wordHeap) Push(x any)         { h.words = append(h.words, x.(WordCount)) }
+func (h *wordHeap) Pop() any {
+	last := h.words[len(h.words)-1]
+	h.words = h.words[:len(h.words)-1]
+	return last
+}
@@ -0,0 +1,180 @@
+package wordcounter
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"unicode/utf8"
+)
+
+// Word map of a large corpus, counts skewed like real text so the heap has a clear top to keep
+func benchWordMap(words int) map[string]int {
+	vocabulary := benchVocabulary(words)
+	wordMap := make(map[string]int, len(vocabulary))
+	for i, word := range vocabulary {
+		wordMap[word] += len(vocabulary)/(i+1) + 1
+	}
+	return wordMap
+}
+
+// What sortWordMap did before the heap, every word sorted and the slice cut to the top N, to check the heap against
+func fullSortWordMap(wordMap map[string]int, top int, minCount int, score func(word string, count int) float64, sortBy SortBy, ascending bool) []WordCount {
+	words := []WordCount{}
+	for k, v := range wordMap {
+		if v < minCount {
+			continue
+		}
+		wordCount := WordCount{Word: k, Count: v}
+		if score != nil {
+			wordCount.Score = score(k, v)
+		}
+		words = append(words, wordCount)
+	}
+
+	sort.Slice(words, func(i, j int) bool {
+		a, b := words[i], words[j]
+		if sortBy == SortLength {
+			if lengthA, lengthB := utf8.RuneCountInString(a.Word), utf8.RuneCountInString(b.Word); lengthA != lengthB {
+				return (lengthA > lengthB) != ascending
+			}
+		}
+		if a.Score != b.Score {
+			return (a.Score > b.Score) != ascending
+		}
+		if a.Count != b.Count {
+			return (a.Count > b.Count) != ascending
+		}
+		return a.Word < b.Word
+	})
+
+	if len(words) > top {
+		words = words[:top]
+	}
+	return words
+}
+
+func TestSortWordMapMatchesFullSort(t *testing.T) {
+	wordMap := benchWordMap(5000)
+	// plenty of ties on count so the alphabetical tie break is exercised too
+	for word := range benchWordMap(2000) {
+		wordMap[word] = 7
+	}
+	score := func(word string, count int) float64 {
+		return float64(count) / float64(len(word))
+	}
+
+	for _, sortBy := range []SortBy{SortCount, SortLength} {
+		for _, ascending := range []bool{false, true} {
+			for _, top := range []int{0, 1, 10, 100, 10000} {
+				for _, minCount := range []int{0, 7, 50} {
+					for _, scored := range []bool{false, true} {
+						var scoreFn func(string, int) float64
+						if scored {
+							scoreFn = score
+						}
+						name := fmt.Sprintf("sort=%s/ascending=%t/top=%d/min-count=%d/scored=%t", sortBy, ascending, top, minCount, scored)
+						t.Run(name, func(t *testing.T) {
+							got := *sortWordMap(&wordMap, top, minCount, scoreFn, sortBy, ascending)
+							want := fullSortWordMap(wordMap, top, minCount, scoreFn, sortBy, ascending)
+							if len(got) == 0 && len(want) == 0 {
+								return
+							}
+							if !reflect.DeepEqual(got, want) {
+								t.Errorf("heap and full sort differ\n got: %v\nwant: %v", got, want)
+							}
+						})
+					}
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkSortWordMap(b *testing.B) {
+	for _, words := range []int{10000, 200000, 1000000} {
+		wordMap := benchWordMap(words)
+		for _, top := range []int{10, 1000} {
+			b.Run(fmt.Sprintf("words=%d/top=%d/heap", words, top), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					sortWordMap(&wordMap, top, 0, nil, SortCount, false)
+				}
+			})
+			b.Run(fmt.Sprintf("words=%d/top=%d/full-sort", words, top), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					fullSortWordMap(wordMap, top, 0, nil, SortCount, false)
+				}
+			})
+		}
+	}
+}
+
+func TestSortWordMapTies(t *testing.T) {
+	tests := []struct {
+		name      string
+		wordMap   map[string]int
+		top       int
+		ascending bool
+		want      []string
+	}{
+		{
+			name:    "all tied",
+			wordMap: map[string]int{"pear": 2, "apple": 2, "melon": 2, "fig": 2},
+			top:     10,
+			want:    []string{"apple", "fig", "melon", "pear"},
+		},
+		{
+			name:    "ties under a higher count",
+			wordMap: map[string]int{"zebra": 5, "yak": 3, "ant": 3, "bee": 3},
+			top:     10,
+			want:    []string{"zebra", "ant", "bee", "yak"},
+		},
+		{
+			name:    "top cuts through a tie",
+			wordMap: map[string]int{"delta": 4, "charlie": 4, "bravo": 4, "alpha": 4},
+			top:     2,
+			want:    []string{"alpha", "bravo"},
+		},
+		{
+			name:      "ascending keeps ties alphabetical",
+			wordMap:   map[string]int{"zebra": 5, "yak": 3, "ant": 3, "bee": 1},
+			top:       10,
+			ascending: true,
+			want:      []string{"bee", "ant", "yak", "zebra"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the map is ranged in a different order on every call, so a few runs would catch an unstable order
+			for run := 0; run < 20; run++ {
+				var got []string
+				for _, wordCount := range *sortWordMap(&tt.wordMap, tt.top, 0, nil, SortCount, tt.ascending) {
+					got = append(got, wordCount.Word)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// No words at all are an empty slice, which is an empty array in the output instead of null
+func TestSortWordMapEmpty(t *testing.T) {
+	wordMap := map[string]int{"rare": 1}
+	for _, tt := range []struct {
+		name     string
+		wordMap  map[string]int
+		minCount int
+	}{
+		{"no words", map[string]int{}, 0},
+		{"all under the min count", wordMap, 2},
+	} {
+		if words := *sortWordMap(&tt.wordMap, 10, tt.minCount, nil, SortCount, false); words == nil || len(words) != 0 {
+			t.Errorf("%s: sortWordMap() = %#v, want an empty slice", tt.name, words)
+		}
+	}
+}
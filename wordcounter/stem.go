@@ -0,0 +1,84 @@
+package wordcounter
+
+import "strings"
+
+/*
+Reduce a lowercase word to its stem so plural and inflected forms are counted together, e.g. cats -> cat,
+running -> run and agreed -> agree. This is the plural and -ed/-ing steps of the Porter stemmer, which covers the
+forms that fragment the counts the most without the full algorithm. Stems are not always words themselves, e.g.
+computing -> comput
+*/
+func stemWord(word string) string {
+	word = stemPlural(word)
+	return stemInflection(word)
+}
+
+// Strip plural endings: sses -> ss, ies -> y, s -> "" (but not ss or us, as in class and status)
+func stemPlural(word string) string {
+	switch {
+	case strings.HasSuffix(word, "sses"):
+		return word[:len(word)-2]
+	case strings.HasSuffix(word, "ies") && len(word) > 4:
+		return word[:len(word)-3] + "y"
+	case strings.HasSuffix(word, "ss"), strings.HasSuffix(word, "us"):
+		return word
+	case strings.HasSuffix(word, "s") && len(word) > 3 && hasVowel(word[:len(word)-1]):
+		return word[:len(word)-1]
+	}
+	return word
+}
+
+// Strip -ed and -ing when what is left still has a vowel, then tidy up the stem the way Porter does. -eed is only
+// shortened to -ee when what comes before it has a vowel followed by a consonant, so agreed -> agree but speed stays
+func stemInflection(word string) string {
+	if strings.HasSuffix(word, "eed") {
+		if hasMeasure(word[:len(word)-3]) {
+			return word[:len(word)-1]
+		}
+		return word
+	}
+
+	var stem string
+	switch {
+	case strings.HasSuffix(word, "ing") && hasVowel(word[:len(word)-3]):
+		stem = word[:len(word)-3]
+	case strings.HasSuffix(word, "ed") && hasVowel(word[:len(word)-2]):
+		stem = word[:len(word)-2]
+	default:
+		return word
+	}
+
+	switch {
+	// rated -> rate, troubled -> trouble, sized -> size
+	case strings.HasSuffix(stem, "at"), strings.HasSuffix(stem, "bl"), strings.HasSuffix(stem, "iz"):
+		return stem + "e"
+	// running -> run, but falling and kissed keep their double letter
+	case len(stem) > 2 && stem[len(stem)-1] == stem[len(stem)-2] && isConsonant(stem[len(stem)-1]) &&
+		!strings.ContainsRune("lsz", rune(stem[len(stem)-1])):
+		return stem[:len(stem)-1]
+	// hoping -> hope, a short stem ending consonant-vowel-consonant lost an e
+	case len(stem) == 3 && isConsonant(stem[0]) && !isConsonant(stem[1]) && isConsonant(stem[2]) &&
+		!strings.ContainsRune("wxy", rune(stem[2])):
+		return stem + "e"
+	}
+	return stem
+}
+
+func hasVowel(s string) bool {
+	return strings.ContainsAny(s, "aeiouy")
+}
+
+// Whether s has a vowel followed by a consonant, Porter's m > 0
+func hasMeasure(s string) bool {
+	for i := 1; i < len(s); i++ {
+		if !isConsonant(s[i-1]) && isConsonant(s[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Only a-z letters other than vowels count as consonants, so letters of unicode words are never stripped
+func isConsonant(c byte) bool {
+	return c >= 'a' && c <= 'z' && !strings.ContainsRune("aeiou", rune(c))
+}
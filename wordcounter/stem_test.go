@@ -0,0 +1,44 @@
+package wordcounter
+
+import "testing"
+
+func TestStemWord(t *testing.T) {
+	tests := []struct {
+		word string
+		want string
+	}{
+		// plurals
+		{"cats", "cat"},
+		{"caresses", "caress"},
+		{"ponies", "pony"},
+		{"class", "class"},
+		{"status", "status"},
+		{"gas", "gas"},
+		// -eed only loses its d after a vowel and consonant
+		{"agreed", "agree"},
+		{"proceed", "procee"},
+		{"speed", "speed"},
+		{"bleed", "bleed"},
+		{"greed", "greed"},
+		{"feed", "feed"},
+		// -ed and -ing
+		{"running", "run"},
+		{"falling", "fall"},
+		{"kissed", "kiss"},
+		{"rated", "rate"},
+		{"troubled", "trouble"},
+		{"sized", "size"},
+		{"hoping", "hope"},
+		{"computing", "comput"},
+		{"sing", "sing"},
+		{"bled", "bled"},
+		// a short consonant-vowel-consonant stem gets its e back, like Porter
+		{"during", "dure"},
+		{"fixing", "fix"},
+	}
+	for _, tt := range tests {
+		if got := stemWord(tt.word); got != tt.want {
+			t.Errorf("stemWord(%q) = %q, want %q", tt.word, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package wordcounter
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Word bank of the assignment, used when no other word bank is given
+const WordBankUrl = "https://raw.githubusercontent.com/dwyl/english-words/master/words.txt"
+
+// Times a word bank download is retried, the file is a few MB and the download occasionally stalls
+const wordBankRetries = 2
+
+// Small list of common english words used when the word bank can't be downloaded, one per line like the word bank
+//
+//go:embed fallback-words.txt
+var FallbackWordBank string
+
+// Common english words that are excluded from the count by default (Config.NoBuiltinStopwords or
+// -no-builtin-stopwords counts them), one per line like the word bank
+const BuiltinStopwords = `the
+and
+that
+for
+with
+this
+from
+are
+was
+were
+but
+not
+have
+has
+had
+you
+your
+they
+their
+them
+its
+our
+his
+her
+she
+him
+who
+what
+which
+when
+where
+how
+all
+can
+will
+would
+there
+been
+also
+more
+one
+than
+then
+into
+out
+about
+just
+like
+some
+any
+these
+those
+only
+other
+such
+over
+after
+before
+because
+very
+could
+should
+may
+even
+most
+being
+does
+did
+get
+got`
+
+/*
+Load the word bank of every source and merge them into one. A download that still fails after its retries falls back to
+the small embedded word bank so an offline run still produces a result (unless noFallback is set), a local word bank
+file that can't be read is always returned as an error
+*/
+func loadWordBanks(ctx context.Context, client *http.Client, sources []string, cacheDir string, ttl time.Duration, refresh bool, noFallback bool) (*map[string]struct{}, error) {
+	wordBank := &map[string]struct{}{}
+	for _, source := range sources {
+		// each source has its own cache file, caching is skipped if there is no cache dir
+		cachePath := ""
+		if cacheDir != "" {
+			cachePath = wordBankCachePath(cacheDir, source)
+		}
+		sourceWordBank, err := getWordBank(ctx, client, source, cachePath, ttl, refresh)
+		if err != nil && isWordBankUrl(source) && !noFallback && ctx.Err() == nil {
+			slog.Warn("Failed to download word bank, using the embedded fallback word bank instead",
+				"source", source, "error", err)
+			sourceWordBank, err = scanWordBank(strings.NewReader(FallbackWordBank))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", source, err)
+		}
+		slog.Info("Loaded word bank", "source", source, "words", len(*sourceWordBank))
+
+		for word := range *sourceWordBank {
+			(*wordBank)[word] = struct{}{}
+		}
+	}
+
+	if len(sources) > 1 {
+		slog.Info("Merged word banks", "sources", len(sources), "words", len(*wordBank))
+	}
+
+	return wordBank, nil
+}
+
+// Whether the word bank source is downloaded rather than read from a local file
+func isWordBankUrl(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+/*
+Fetch the wordbank from the source given, this is a list of all words that are valid.
+However they may be words in this list invalidated by regex rules as part of word validations
+
+The source is either an http(s) URL or a local file path. For URLs, if cachePath is set the word bank is loaded from
+there when the cache is younger than ttl, otherwise (or if reading the cache fails) it is downloaded and the cache is
+rewritten. refresh forces a download. A download that fails or stalls past the client's timeout is retried
+wordBankRetries times with exponential backoff (1s, 2s...), unless the context is cancelled. Local files are never
+cached.
+*/
+func getWordBank(ctx context.Context, client *http.Client, source string, cachePath string, ttl time.Duration, refresh bool) (*map[string]struct{}, error) {
+	if !isWordBankUrl(source) {
+		return readWordBankFile(source)
+	}
+
+	if cachePath != "" && !refresh {
+		if info, err := os.Stat(cachePath); err == nil && time.Since(info.ModTime()) < ttl {
+			wordBank, err := readWordBankFile(cachePath)
+			if err == nil {
+				slog.Debug("Loaded word bank from cache", "path", cachePath)
+				return wordBank, nil
+			}
+			slog.Warn("Failed to read cached word bank, downloading it instead", "path", cachePath, "error", err)
+		}
+	}
+
+	backoff := time.Second
+	for retry := 0; ; retry++ {
+		wordBank, err := downloadWordBank(ctx, client, source, cachePath)
+		if err == nil || ctx.Err() != nil {
+			return wordBank, err
+		}
+		if retry == wordBankRetries {
+			return nil, fmt.Errorf("after %d retries: %w", retry, err)
+		}
+		slog.Warn("Failed to download word bank, retrying", "source", source, "attempt", retry+1, "backoff", backoff, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// Download the word bank once, writing it to cachePath as well if it's set
+func downloadWordBank(ctx context.Context, client *http.Client, source string, cachePath string) (*map[string]struct{}, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d fetching word bank", resp.StatusCode)
+	}
+
+	if cachePath == "" {
+		return scanWordBank(resp.Body)
+	}
+
+	// Write the body to a temp file while scanning it, then move it into place so a failed download never leaves a partial cache
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), "words-*.txt")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	wordBank, err := scanWordBank(io.TeeReader(resp.Body, tmp))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmp.Name(), cachePath); err != nil {
+		slog.Warn("Failed to cache word bank", "path", cachePath, "error", err)
+	}
+
+	return wordBank, nil
+}
+
+// Load a word list from a file on disk, either a local word bank, the cache or a stopwords file
+func readWordBankFile(filePath string) (*map[string]struct{}, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return scanWordBank(f)
+}
+
+// Read one word per line into the word bank set, words are lowercased so they match the lowercase only regex
+func scanWordBank(r io.Reader) (*map[string]struct{}, error) {
+	wordBank := map[string]struct{}{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		word := strings.ToLower(scanner.Text())
+		wordBank[word] = struct{}{}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &wordBank, nil
+}
+
+// Directory the word banks are cached in, i.e. $XDG_CACHE_HOME/firefly on linux
+func wordBankCacheDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(cacheDir, "firefly"), nil
+}
+
+// Location of the cached word bank of a source, keyed by a hash of the URL so different word banks don't share a cache
+func wordBankCachePath(cacheDir string, source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return filepath.Join(cacheDir, "words-"+hex.EncodeToString(sum[:8])+".txt")
+}
@@ -0,0 +1,86 @@
+package wordcounter
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// The limit is only halved once per this long, about the first rate limit backoff, so the burst of 429s for the
+// requests that were already in flight when the site started rate limiting doesn't drop it to 1 straight away
+const adaptiveDecreaseInterval = time.Second
+
+/*
+Number of workers allowed to fetch essays at once with WithAdaptiveWorkers, adjusted like TCP congestion control
+(additive increase, multiplicative decrease). It starts at a few workers per CPU, goes up by one once as many essays
+as the limit were fetched in a row without being rate limited, and is halved whenever a response is rate limited
+(429 or 503). It stays between 1 and maxWorkers
+*/
+type adaptiveWorkers struct {
+	mtx        sync.Mutex
+	cond       *sync.Cond
+	maxWorkers int
+	limit      int
+	active     int
+	// essays fetched without being rate limited since the limit last changed
+	fetched      int
+	lastDecrease time.Time
+}
+
+func newAdaptiveWorkers(maxWorkers int) *adaptiveWorkers {
+	a := &adaptiveWorkers{maxWorkers: maxWorkers, limit: min(maxWorkers, 4*runtime.GOMAXPROCS(0))}
+	a.cond = sync.NewCond(&a.mtx)
+	return a
+}
+
+// Wait until fewer workers than the limit are fetching, then count the caller as one of them
+func (a *adaptiveWorkers) acquire() {
+	a.mtx.Lock()
+	for a.active >= a.limit {
+		a.cond.Wait()
+	}
+	a.active++
+	a.mtx.Unlock()
+}
+
+// Called once a worker's essay is done, ok if it was fetched, which raises the limit once enough were in a row
+func (a *adaptiveWorkers) release(ok bool) {
+	a.mtx.Lock()
+	a.active--
+	if ok {
+		a.fetched++
+		if a.fetched >= a.limit && a.limit < a.maxWorkers {
+			a.limit++
+			a.fetched = 0
+			slog.Debug("Raised the number of workers", "workers", a.limit)
+		}
+	}
+	a.mtx.Unlock()
+	a.cond.Broadcast()
+}
+
+// Halve the limit on a rate limited response, other status codes don't change it
+func (a *adaptiveWorkers) observeStatus(statusCode int) {
+	if statusCode != http.StatusTooManyRequests && statusCode != http.StatusServiceUnavailable {
+		return
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.fetched = 0
+	if time.Since(a.lastDecrease) < adaptiveDecreaseInterval {
+		return
+	}
+	a.limit = max(1, a.limit/2)
+	a.lastDecrease = time.Now()
+	slog.Debug("Rate limited, lowered the number of workers", "workers", a.limit)
+}
+
+// The current limit, the number of workers the run settled on once it's done
+func (a *adaptiveWorkers) workers() int {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.limit
+}